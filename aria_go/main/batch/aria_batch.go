@@ -0,0 +1,324 @@
+package main
+
+import (
+	"aria_module_media"
+	"aria_module_person"
+	"aria_module_potential"
+	"aria_module_routing"
+	"aria_module_universe"
+	"aria_utility_mqtt"
+	"aria_utility_settings"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 1ステップの結果
+type stepResult struct {
+	Cycle     int
+	Step      int
+	Affected  int
+	Evacuated int
+	Shelters  []aria_utility_mqtt.ShelterEntity // 避難場所の収容人数
+}
+
+// 1回の実行の結果
+type runResult struct {
+	Index      int
+	Seed       int64
+	Aborted    bool
+	Persons    int    // 全てのパーソンの数
+	StopReason string // 最後のサイクルを終了した理由
+	Steps      []stepResult
+}
+
+// 1回の実行の設定
+type runJob struct {
+	settings  aria_utility_settings.SettingEntity
+	directory string
+}
+
+// 集計するステップ（サイクル、ステップ）
+type stepKey struct {
+	cycle int
+	step  int
+}
+
+// t分布の97.5%点（自由度1から30、それ以上は正規分布の値を使う）
+var tValues = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+func main() {
+	settingFileName := "../../../data/settings.json"
+
+	// コマンドライン引数から設定ファイル名を取得する
+	runs := flag.Int("runs", 10, "number of replications")
+	parallel := flag.Int("parallel", 4, "number of replications run at the same time")
+	seed := flag.Int64("seed", 1, "seed of the first replication (the following replications use seed+1, seed+2, ...)")
+	cycles := flag.Int("cycles", 1, "number of cycles in each replication")
+	outputPath := flag.String("out", "./result/batch", "directory to write the results of each replication and the summary")
+	isSweep := flag.Bool("sweep", false, "expand the Sweep section of the settings and run the replications for each sample")
+	flag.Parse()
+	if len(flag.Args()) > 0 {
+		settingFileName = flag.Args()[0]
+	}
+	if *runs < 1 || *parallel < 1 || *cycles < 1 {
+		fmt.Println("usage: aria_batch [-runs N] [-parallel N] [-seed N] [-cycles N] [-out directory] [-sweep] [settings file]")
+		os.Exit(2)
+	}
+
+	// 設定ファイル読み込み
+	settings := aria_utility_settings.LoadSettings(settingFileName)
+	os.Chdir(settings.RootPath)
+
+	// 組み込みMQTTブローカーの起動（全ての実行で共有する）
+	if settings.EmbeddedBrokerPort > 0 {
+		broker, err := aria_utility_mqtt.StartBroker(fmt.Sprintf(":%d", settings.EmbeddedBrokerPort), settings.MaxPacketSize)
+		if err != nil {
+			panic(err)
+		}
+		defer broker.Close()
+	}
+	if err := os.MkdirAll(*outputPath, 0777); err != nil {
+		panic(err)
+	}
+
+	// パラメータスイープ
+	if *isSweep {
+		if err := sweep(settings, *outputPath, *runs, *parallel, *seed, *cycles); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	jobs := []runJob{}
+	for index := 0; index < *runs; index++ {
+		job := runJob{
+			settings:  settings,
+			directory: filepath.Join(*outputPath, fmt.Sprintf("run%03d", index)),
+		}
+		job.settings.UniverseID = fmt.Sprintf("%s-run%03d", settings.UniverseID, index)
+		job.settings.Seed = *seed + int64(index)
+		jobs = append(jobs, job)
+	}
+	start := time.Now()
+	results := runAll(jobs, *parallel, *cycles)
+
+	// 集計結果を出力
+	fileName := filepath.Join(*outputPath, "summary.csv")
+	if err := writeSummary(fileName, results); err != nil {
+		panic(err)
+	}
+	fmt.Printf("%d runs finished in %d ms -> %s\n", *runs, time.Now().Sub(start).Milliseconds(), fileName)
+}
+
+// 複数の実行を並列に実行（UniverseIDを実行毎に変えるので、同じブローカーで干渉しない）
+func runAll(jobs []runJob, parallel int, cycles int) []runResult {
+	results := make([]runResult, len(jobs))
+	semaphore := make(chan bool, parallel)
+	waiter := sync.WaitGroup{}
+	for index := range jobs {
+		waiter.Add(1)
+		semaphore <- true
+		go func(index int) {
+			defer waiter.Done()
+			defer func() { <-semaphore }()
+
+			results[index] = run(jobs[index].settings, index, jobs[index].directory, cycles)
+
+			result := results[index]
+			last := stepResult{}
+			if len(result.Steps) > 0 {
+				last = result.Steps[len(result.Steps)-1]
+			}
+			fmt.Printf("Run %3d Finished | Seed %d | %4d Steps | Affected %4d | Evacuated %4d | Stop %s | Aborted %v\n", index, result.Seed, len(result.Steps), last.Affected, last.Evacuated, result.StopReason, result.Aborted)
+		}(index)
+	}
+	waiter.Wait()
+	return results
+}
+
+// 1回の実行（全てのモジュールをプロセス内で起動して、指定したサイクル数を実行する）
+func run(settings aria_utility_settings.SettingEntity, index int, directory string, cycles int) runResult {
+	result := runResult{
+		Index: index,
+		Seed:  settings.Seed,
+		Steps: []stepResult{},
+	}
+
+	// 入力待ちや遠隔操作はしない、旧トピック名は実行同士で干渉するので使わない
+	settings.ControlAddress = ""
+	settings.MinimumStepTime = 0
+	settings.LegacyTopics = false
+	settings.RestorePath = ""
+	if err := os.MkdirAll(directory, 0777); err != nil {
+		panic(err)
+	}
+	if settings.RecordFilePath != "" {
+		settings.RecordFilePath = filepath.Join(directory, "record.jsonl")
+	}
+	settings.CheckpointPath = filepath.Join(directory, "checkpoints")
+
+	// 実際に使った設定を保存（シードを含む）
+	bytes, _ := json.MarshalIndent(settings, "", "  ")
+	if err := os.WriteFile(filepath.Join(directory, "settings.json"), bytes, 0644); err != nil {
+		panic(err)
+	}
+
+	// モジュール起動
+	var universeModule aria_module_universe.UniverseModule
+	universeModule.Initialize(settings).Wait()
+	defer universeModule.Uninitialize()
+
+	if len(settings.Nodes) > 0 {
+		var routingModule aria_module_routing.RoutingModule
+		routingModule.Initialize(settings, settings.Nodes[0]).Wait()
+		defer routingModule.Uninitialize()
+	}
+	for _, nodeEntity := range settings.Nodes {
+		personModule := &aria_module_person.PersonModule{}
+		personModule.Initialize(settings, nodeEntity).Wait()
+		defer personModule.Uninitialize()
+	}
+	for _, potentialEntity := range settings.Potentials {
+		potentialModule := &aria_module_potential.PotentialModule{}
+		potentialModule.Initialize(settings, potentialEntity).Wait()
+		defer potentialModule.Uninitialize()
+
+		mediaModule := &aria_module_media.MediaModule{}
+		mediaModule.Initialize(settings, potentialEntity).Wait()
+		defer mediaModule.Uninitialize()
+	}
+
+	// サイクルの実行
+	for cycle := 0; cycle < cycles && !universeModule.Aborted; cycle++ {
+		universeModule.PublishCycle().Wait()
+		for !universeModule.NeedsCycleStart {
+			universeModule.PublishStep().Wait()
+			if universeModule.Aborted {
+				break
+			}
+			result.Steps = append(result.Steps, stepResult{
+				Cycle:     cycle,
+				Step:      universeModule.StepCount - 1,
+				Affected:  universeModule.Affected,
+				Evacuated: universeModule.Evacuated,
+				Shelters:  universeModule.Shelters,
+			})
+		}
+	}
+	result.Aborted = universeModule.Aborted
+	result.Persons = len(universeModule.Persons)
+	result.StopReason = universeModule.StopReason
+
+	// 実行毎の結果を出力
+	file, err := os.Create(filepath.Join(directory, "result.csv"))
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "Cycle,Step,Affected,Evacuated\n")
+	for _, step := range result.Steps {
+		fmt.Fprintf(file, "%d,%d,%d,%d\n", step.Cycle, step.Step, step.Affected, step.Evacuated)
+	}
+
+	// 避難場所毎の収容人数を出力（Shelterはノードの避難場所のID、またはポテンシャルの外的要因マップ）
+	if err := writeShelters(filepath.Join(directory, "shelters.csv"), result.Steps); err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// ステップ毎の避難場所の収容人数を出力する
+func writeShelters(fileName string, steps []stepResult) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "Cycle,Step,Shelter,Occupancy,Capacity\n")
+	for _, step := range steps {
+		for _, shelter := range step.Shelters {
+			name := shelter.Map
+			if name == "" {
+				name = fmt.Sprint(shelter.NID)
+			}
+			fmt.Fprintf(file, "%d,%d,%s,%d,%d\n", step.Cycle, step.Step, name, shelter.Occupancy, shelter.Capacity)
+		}
+	}
+	return nil
+}
+
+// 中止しなかった実行のステップ毎の平均と95%信頼区間を出力する
+func writeSummary(fileName string, results []runResult) error {
+	values := make(map[stepKey][][2]float64)
+	for _, result := range results {
+		if result.Aborted {
+			continue
+		}
+		for _, step := range result.Steps {
+			key := stepKey{step.Cycle, step.Step}
+			values[key] = append(values[key], [2]float64{float64(step.Affected), float64(step.Evacuated)})
+		}
+	}
+	keys := []stepKey{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].cycle != keys[j].cycle {
+			return keys[i].cycle < keys[j].cycle
+		}
+		return keys[i].step < keys[j].step
+	})
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "Cycle,Step,Runs,AffectedMean,AffectedLower,AffectedUpper,EvacuatedMean,EvacuatedLower,EvacuatedUpper\n")
+	for _, key := range keys {
+		affectedMean, affectedMargin := meanInterval(values[key], 0)
+		evacuatedMean, evacuatedMargin := meanInterval(values[key], 1)
+		fmt.Fprintf(file, "%d,%d,%d,%f,%f,%f,%f,%f,%f\n", key.cycle, key.step, len(values[key]),
+			affectedMean, affectedMean-affectedMargin, affectedMean+affectedMargin,
+			evacuatedMean, evacuatedMean-evacuatedMargin, evacuatedMean+evacuatedMargin)
+	}
+	return nil
+}
+
+// 平均と95%信頼区間の幅（t分布、1回だけの場合は幅0）
+func meanInterval(values [][2]float64, column int) (float64, float64) {
+	count := len(values)
+	sum := 0.0
+	for _, value := range values {
+		sum += value[column]
+	}
+	mean := sum / float64(count)
+	if count < 2 {
+		return mean, 0
+	}
+
+	variance := 0.0
+	for _, value := range values {
+		variance += (value[column] - mean) * (value[column] - mean)
+	}
+	variance /= float64(count - 1)
+
+	t := 1.960
+	if count-1 <= len(tValues) {
+		t = tValues[count-2]
+	}
+	return mean, t * math.Sqrt(variance/float64(count))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"aria_utility_settings"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// パラメータスイープ（サンプル毎に具体的なシナリオを出力して、全てのサンプルを同じシードの組で実行する）
+func sweep(settings aria_utility_settings.SettingEntity, outputPath string, runs int, parallel int, seed int64, cycles int) error {
+	samples, err := settings.Sweep.Expand()
+	if err != nil {
+		return err
+	}
+	if settings.Sweep.Runs > 0 {
+		runs = settings.Sweep.Runs
+	}
+
+	jobs := []runJob{}
+	for no, sample := range samples {
+		directory := filepath.Join(outputPath, fmt.Sprintf("sample%03d", no))
+		scenario, err := writeScenario(settings, sample, directory)
+		if err != nil {
+			return err
+		}
+		for index := 0; index < runs; index++ {
+			job := runJob{
+				settings:  scenario,
+				directory: filepath.Join(directory, fmt.Sprintf("run%03d", index)),
+			}
+			job.settings.UniverseID = fmt.Sprintf("%s-sample%03d-run%03d", settings.UniverseID, no, index)
+			job.settings.Seed = seed + int64(index)
+			jobs = append(jobs, job)
+		}
+	}
+	start := time.Now()
+	results := runAll(jobs, parallel, cycles)
+
+	// サンプル毎の集計結果を出力
+	for no := range samples {
+		if err := writeSummary(filepath.Join(outputPath, fmt.Sprintf("sample%03d", no), "summary.csv"), results[no*runs:(no+1)*runs]); err != nil {
+			return err
+		}
+	}
+	fileName := filepath.Join(outputPath, "sweep.csv")
+	if err := writeSweep(fileName, settings.Sweep.Names(), samples, runs, results); err != nil {
+		return err
+	}
+	fmt.Printf("%d samples x %d runs finished in %d ms -> %s\n", len(samples), runs, time.Now().Sub(start).Milliseconds(), fileName)
+	return nil
+}
+
+// サンプルの値を適用した具体的なシナリオ（設定ファイルと書き換えたCSV）をdirectoryに出力する
+func writeScenario(settings aria_utility_settings.SettingEntity, sample aria_utility_settings.SweepSample, directory string) (aria_utility_settings.SettingEntity, error) {
+	if err := os.MkdirAll(directory, 0777); err != nil {
+		return settings, err
+	}
+
+	// 他のサンプルと共有しないように、書き換える配列を複製する
+	parameters := settings.Sweep.Parameters
+	settings.Sweep = aria_utility_settings.SettingSweepEntity{}
+	settings.Nodes = append([]aria_utility_settings.SettingNodeEntity{}, settings.Nodes...)
+	settings.Potentials = append([]aria_utility_settings.SettingPotentialEntity{}, settings.Potentials...)
+	for i := range settings.Potentials {
+		settings.Potentials[i].Media = append([]aria_utility_settings.SettingPotentialMediaEntity{}, settings.Potentials[i].Media...)
+	}
+
+	for no, parameter := range parameters {
+		value := sample[no]
+		switch parameter.Name {
+		case aria_utility_settings.SweepAnnounceStep:
+			if settings.ScenarioFilePath != "" {
+				scenario, err := aria_utility_settings.LoadScenario(settings)
+				if err != nil {
+					return settings, err
+				}
+				for i := range scenario.Cycles {
+					scenario.Cycles[i].AnnounceStep = int(value)
+				}
+				fileName := filepath.Join(directory, "scenario.json")
+				bytes, _ := json.MarshalIndent(scenario, "", "  ")
+				if err := os.WriteFile(fileName, bytes, 0644); err != nil {
+					return settings, err
+				}
+				settings.ScenarioFilePath = fileName
+				continue
+			}
+			fileName := filepath.Join(directory, "setting_universe.csv")
+			if err := rewriteColumn(settings.UniverseFilePath, fileName, 0, func(float64) float64 { return value }); err != nil {
+				return settings, err
+			}
+			settings.UniverseFilePath = fileName
+		case aria_utility_settings.SweepMaximumInfluenceLength:
+			for i := range settings.Nodes {
+				settings.Nodes[i].MaximumInfluenceLength = int(value)
+			}
+		case aria_utility_settings.SweepPrepareTimeoutScale:
+			for i := range settings.Nodes {
+				fileName := filepath.Join(directory, fmt.Sprintf("persons_node%d.csv", i))
+				if err := rewriteColumn(settings.Nodes[i].PersonFilePath, fileName, 3, func(prepare float64) float64 { return math.Round(prepare * value) }); err != nil {
+					return settings, err
+				}
+				settings.Nodes[i].PersonFilePath = fileName
+			}
+			for i := range settings.Potentials {
+				fileName := filepath.Join(directory, fmt.Sprintf("persons_potential%d.csv", i))
+				if err := rewriteColumn(settings.Potentials[i].PersonFilePath, fileName, 3, func(prepare float64) float64 { return math.Round(prepare * value) }); err != nil {
+					return settings, err
+				}
+				settings.Potentials[i].PersonFilePath = fileName
+			}
+		case aria_utility_settings.SweepMediaAcquisition:
+			for i := range settings.Potentials {
+				for j := range settings.Potentials[i].Media {
+					settings.Potentials[i].Media[j].Acquisition = value
+				}
+			}
+		}
+	}
+
+	bytes, _ := json.MarshalIndent(settings, "", "  ")
+	return settings, os.WriteFile(filepath.Join(directory, "settings.json"), bytes, 0644)
+}
+
+// CSVファイルの指定した列の値を書き換えて別のファイルに出力する（1行目は見出し、数値でない値はそのまま）
+func rewriteColumn(sourceFileName string, fileName string, column int, convert func(float64) float64) error {
+	source, err := os.Open(sourceFileName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	reader := csv.NewReader(source)
+	reader.FieldsPerRecord = -1
+	lines, err := reader.ReadAll()
+	if err != nil {
+		return fmt.Errorf("%s: %v", sourceFileName, err)
+	}
+	for index, line := range lines {
+		if index == 0 || column >= len(line) {
+			continue
+		}
+		if value, err := strconv.ParseFloat(line[column], 64); err == nil {
+			line[column] = strconv.FormatFloat(convert(value), 'f', -1, 64)
+		}
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	writer.WriteAll(lines)
+	return writer.Error()
+}
+
+// サンプル毎に1行の結果の表を出力する（中止しなかった実行の平均）
+// 避難率の到達ステップは、全ての実行で到達した場合のみ平均（それ以外は-1）
+func writeSweep(fileName string, names []string, samples []aria_utility_settings.SweepSample, runs int, results []runResult) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "Sample")
+	for _, name := range names {
+		fmt.Fprintf(file, ",%s", name)
+	}
+	fmt.Fprintf(file, ",Runs,Aborted,Persons,AffectedMean,EvacuatedMean,EvacuatedLower,EvacuatedUpper,EvacuatedRatio,Evacuated50Step,Evacuated90Step\n")
+
+	for no, sample := range samples {
+		values := [][2]float64{}
+		persons := 0
+		aborted := 0
+		reached := [2][]float64{}
+		for _, result := range results[no*runs : (no+1)*runs] {
+			if result.Aborted || len(result.Steps) == 0 {
+				aborted++
+				continue
+			}
+			last := result.Steps[len(result.Steps)-1]
+			values = append(values, [2]float64{float64(last.Affected), float64(last.Evacuated)})
+			persons = result.Persons
+			for i, ratio := range []float64{0.5, 0.9} {
+				for index, step := range result.Steps {
+					if float64(step.Evacuated) >= ratio*float64(result.Persons) {
+						reached[i] = append(reached[i], float64(index))
+						break
+					}
+				}
+			}
+		}
+
+		fmt.Fprintf(file, "%d", no)
+		for _, value := range sample {
+			fmt.Fprintf(file, ",%v", value)
+		}
+		if len(values) == 0 {
+			fmt.Fprintf(file, ",%d,%d,0,,,,,,,\n", runs, aborted)
+			continue
+		}
+		affectedMean, _ := meanInterval(values, 0)
+		evacuatedMean, evacuatedMargin := meanInterval(values, 1)
+		ratio := 0.0
+		if persons > 0 {
+			ratio = evacuatedMean / float64(persons)
+		}
+		steps := [2]float64{-1, -1}
+		for i := range reached {
+			if len(reached[i]) == len(values) {
+				sum := 0.0
+				for _, step := range reached[i] {
+					sum += step
+				}
+				steps[i] = sum / float64(len(reached[i]))
+			}
+		}
+		fmt.Fprintf(file, ",%d,%d,%d,%f,%f,%f,%f,%f,%f,%f\n", runs, aborted, persons,
+			affectedMean, evacuatedMean, evacuatedMean-evacuatedMargin, evacuatedMean+evacuatedMargin, ratio, steps[0], steps[1])
+	}
+	return nil
+}
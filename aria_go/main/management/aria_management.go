@@ -4,9 +4,11 @@ import (
 	"aria_module_media"
 	"aria_module_person"
 	"aria_module_potential"
+	"aria_module_recorder"
 	"aria_module_routing"
 	"aria_module_universe"
 	"aria_utility_floods"
+	"aria_utility_mqtt"
 	"aria_utility_nodes"
 	"aria_utility_settings"
 	"flag"
@@ -26,16 +28,41 @@ func main() {
 	// settingFileName := "../../../data/settings.json"
 
 	// コマンドライン引数から設定ファイル名を取得する
+	schemaFileName := flag.String("schema", "", "write the JSON Schema of the MQTT entities to the file and exit")
 	flag.Parse()
 	if len(flag.Args()) > 0 {
 		settingFileName = flag.Args()[0]
 	}
 
+	// スキーマの出力
+	if *schemaFileName != "" {
+		if err := os.WriteFile(*schemaFileName, aria_utility_mqtt.Schema(), 0644); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	settings := aria_utility_settings.LoadSettings(settingFileName)
 	potentialMeshSize := 0.0
 
 	os.Chdir(settings.RootPath)
 
+	// 組み込みMQTTブローカーの起動（他のプロセスのモジュールはここに接続する）
+	if settings.EmbeddedBrokerPort > 0 {
+		broker, err := aria_utility_mqtt.StartBroker(fmt.Sprintf(":%d", settings.EmbeddedBrokerPort), settings.MaxPacketSize)
+		if err != nil {
+			panic(err)
+		}
+		defer broker.Close()
+	}
+
+	// 全てのメッセージの記録（他のモジュールの参加より先に開始する）
+	var recorderModule aria_module_recorder.RecorderModule
+	if settings.RecordFilePath != "" {
+		recorderModule.Initialize(settings).Wait()
+		defer recorderModule.Uninitialize()
+	}
+
 	var universeModule aria_module_universe.UniverseModule
 	universeModule.Initialize(settings).Wait()
 	defer universeModule.Uninitialize()
@@ -88,9 +115,16 @@ func main() {
 		}
 	}
 
+	// 実行するサイクルのシナリオ（地図、洪水、メディアの変更）
+	scenario, err := aria_utility_settings.LoadScenario(settings)
+	if err != nil {
+		panic(err)
+	}
+	cycle := scenario.Cycle(universeModule.CycleCount)
+
 	// ノードを使ったマップの描画
 	if len(settings.Nodes) > 0 {
-		nodes := aria_utility_nodes.LoadMap(settings, settings.Nodes[0])
+		nodes := aria_utility_nodes.LoadScenarioMap(settings, settings.Nodes[0], cycle)
 		for _, node := range nodes {
 			for _, neighbor := range node.Neighbors {
 				for v := 0.0; v < 1; v += 0.01 {
@@ -108,6 +142,11 @@ func main() {
 		}
 	}
 
+	// 遠隔操作の場合は開始の要求を待つ
+	if settings.ControlAddress != "" && !universeModule.WaitStart() {
+		return
+	}
+
 	// サイクルを１回だけ実行
 	universeModule.PublishCycle().Wait()
 	for !universeModule.NeedsCycleStart {
@@ -121,7 +160,7 @@ func main() {
 		if len(settings.Nodes) > 0 {
 			floodWidth := int(math.Ceil(settings.MapWidth / settings.FloodMeshSize))
 			floodHeight := int(math.Ceil(settings.MapHeight / settings.FloodMeshSize))
-			floods, _, _ := aria_utility_floods.LoadFloods(settings, floodWidth, floodHeight, universeModule.StepCount)
+			floods, _, _ := aria_utility_floods.LoadFloods(cycle.Apply(settings), floodWidth, floodHeight, universeModule.StepCount)
 			for x := 0; x < imageWidth; x++ {
 				for y := 0; y < imageHeight; y++ {
 					depth := floods[int(float64(x)/imageZoom/settings.FloodMeshSize)][int(float64(y)/imageZoom/settings.FloodMeshSize)]
@@ -155,7 +194,7 @@ func main() {
 					}
 				}
 			}
-			for _, mediaEntity := range settings.Potentials[0].Media {
+			for _, mediaEntity := range cycle.ApplyPotential(settings.Potentials[0]).Media {
 				currentStep := universeModule.StepCount - mediaEntity.Step
 				if 0 <= currentStep && currentStep <= mediaEntity.Duration {
 					cx := mediaEntity.Positions[currentStep%len(mediaEntity.Positions)].X / settings.Potentials[0].MeshSize
@@ -222,7 +261,13 @@ func main() {
 		stepStart := time.Now()
 		universeModule.PublishStep().Wait()
 		stepFinish := time.Now()
+		if universeModule.Aborted {
+			break
+		}
 
 		fmt.Printf("Step %3d Finished | %4d ms | %4d ms | Affected %4d | Evacuated %4d\n", universeModule.StepCount, stepFinish.Sub(stepStart).Milliseconds(), imageFinish.Sub(imageStart).Milliseconds(), universeModule.Affected, universeModule.Evacuated)
+		if !universeModule.WaitStep() {
+			break
+		}
 	}
 }
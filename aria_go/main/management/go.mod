@@ -6,10 +6,11 @@ require (
 	aria_module_media v0.0.0
 	aria_module_person v0.0.0
 	aria_module_potential v0.0.0
+	aria_module_recorder v0.0.0
 	aria_module_routing v0.0.0
 	aria_module_universe v0.0.0
 	aria_utility_floods v0.0.0
-	aria_utility_mqtt v0.0.0 // indirect
+	aria_utility_mqtt v0.0.0
 	aria_utility_nodes v0.0.0
 	aria_utility_settings v0.0.0
 	github.com/eclipse/paho.mqtt.golang v1.3.5 // indirect
@@ -21,6 +22,7 @@ replace aria_module_person => ../../module/person
 replace aria_module_potential => ../../module/potential
 replace aria_module_media => ../../module/media
 replace aria_module_routing => ../../module/routing
+replace aria_module_recorder => ../../module/recorder
 replace aria_utility_mqtt => ../../utility/mqtt
 replace aria_utility_nodes => ../../utility/nodes
 replace aria_utility_floods => ../../utility/floods
@@ -6,6 +6,7 @@ require (
 	aria_module_media v0.0.0
 	aria_module_person v0.0.0
 	aria_module_potential v0.0.0
+	aria_module_recorder v0.0.0
 	aria_module_routing v0.0.0
 	aria_module_universe v0.0.0
 	aria_utility_floods v0.0.0
@@ -22,6 +23,7 @@ replace aria_module_person => ../../module/person_gpu
 replace aria_module_potential => ../../module/potential_gpu
 replace aria_module_media => ../../module/media
 replace aria_module_routing => ../../module/routing
+replace aria_module_recorder => ../../module/recorder
 replace aria_utility_mqtt => ../../utility/mqtt
 replace aria_utility_nodes => ../../utility/nodes
 replace aria_utility_floods => ../../utility/floods
@@ -12,6 +12,7 @@ func main() {
 	settingFileName := "../../../data/settings_potential.json"
 
 	// コマンドライン引数から設定ファイル名を取得する
+	moduleName := flag.String("name", "", "module name (reuses the same person IDs when reconnecting or restarting)")
 	flag.Parse()
 	if len(flag.Args()) > 0 {
 		settingFileName = flag.Args()[0]
@@ -20,6 +21,9 @@ func main() {
 	// 設定ファイル読み込み
 	settings := aria_utility_settings.LoadSettings(settingFileName)
 	os.Chdir(settings.RootPath)
+	if *moduleName != "" {
+		settings.Potentials[0].ModuleName = *moduleName
+	}
 
 	// モジュール起動
 	var potentialModule aria_module_potential.PotentialModule
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"aria_module_recorder"
+	"aria_utility_mqtt"
+	"aria_utility_settings"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+func main() {
+	settingFileName := "../../../data/settings.json"
+
+	// コマンドライン引数から設定ファイル名を取得する
+	isDiff := flag.Bool("diff", false, "compare the results (/person/send/all, /stat/send) of two record files")
+	flag.Parse()
+
+	// 記録ファイルの比較
+	if *isDiff {
+		if len(flag.Args()) != 2 {
+			fmt.Println("usage: aria_recorder -diff <record file> <record file>")
+			os.Exit(2)
+		}
+		os.Exit(diff(flag.Args()[0], flag.Args()[1]))
+	}
+
+	if len(flag.Args()) > 0 {
+		settingFileName = flag.Args()[0]
+	}
+
+	// 設定ファイル読み込み
+	settings := aria_utility_settings.LoadSettings(settingFileName)
+	os.Chdir(settings.RootPath)
+	if settings.RecordFilePath == "" {
+		fmt.Println("RecordFilePath is not set")
+		os.Exit(2)
+	}
+
+	// モジュール起動
+	var recorderModule aria_module_recorder.RecorderModule
+	recorderModule.Initialize(settings).Wait()
+	defer recorderModule.Uninitialize()
+
+	// 入力があったら終了する
+	fmt.Scanln()
+}
+
+// 比較する結果（サイクル、ステップ、種類）
+type resultKey struct {
+	cycle int
+	step  int
+	kind  string
+}
+
+// 2つの記録ファイルの結果を比較して、異なるステップを出力する（同じ場合は0を返す）
+func diff(fileNameA string, fileNameB string) int {
+	resultsA := loadResults(fileNameA)
+	resultsB := loadResults(fileNameB)
+
+	keys := []resultKey{}
+	for key := range resultsA {
+		keys = append(keys, key)
+	}
+	for key := range resultsB {
+		if _, exists := resultsA[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].cycle != keys[j].cycle {
+			return keys[i].cycle < keys[j].cycle
+		}
+		if keys[i].step != keys[j].step {
+			return keys[i].step < keys[j].step
+		}
+		return keys[i].kind < keys[j].kind
+	})
+
+	differences := 0
+	for _, key := range keys {
+		resultA, existsA := resultsA[key]
+		resultB, existsB := resultsB[key]
+		switch {
+		case !existsA || !existsB:
+			fmt.Printf("Cycle %d Step %3d %-4s : only in %s\n", key.cycle, key.step, key.kind, map[bool]string{true: fileNameA, false: fileNameB}[existsA])
+		case resultA != resultB:
+			fmt.Printf("Cycle %d Step %3d %-4s : differs\n", key.cycle, key.step, key.kind)
+		default:
+			continue
+		}
+		differences++
+	}
+	fmt.Printf("%d results compared, %d differences\n", len(keys), differences)
+	if differences > 0 {
+		return 1
+	}
+	return 0
+}
+
+// 記録ファイルから結果を読み込む（Personの順序はモジュールの応答順なので、IDの順に揃える）
+func loadResults(fileName string) map[resultKey]string {
+	records, err := aria_utility_mqtt.LoadRecords(fileName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	results := map[resultKey]string{}
+	for _, record := range records {
+		switch record.Kind {
+		case aria_utility_mqtt.RecordAll:
+			var persons []aria_utility_mqtt.AllEntity
+			json.Unmarshal(record.Payload, &persons)
+			sort.Slice(persons, func(i, j int) bool { return persons[i].ID < persons[j].ID })
+			bytes, _ := json.Marshal(persons)
+			results[resultKey{record.Cycle, record.Step, record.Kind}] = string(bytes)
+		case aria_utility_mqtt.RecordStat:
+			results[resultKey{record.Cycle, record.Step, record.Kind}] = string(record.Payload)
+		}
+	}
+	return results
+}
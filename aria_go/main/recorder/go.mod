@@ -0,0 +1,13 @@
+module aria_recorder.go
+
+go 1.16
+
+require (
+	aria_module_recorder v0.0.0
+	aria_utility_mqtt v0.0.0
+	aria_utility_settings v0.0.0
+)
+
+replace aria_module_recorder => ../../module/recorder
+replace aria_utility_mqtt => ../../utility/mqtt
+replace aria_utility_settings => ../../utility/settings
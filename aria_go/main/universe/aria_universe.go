@@ -2,6 +2,7 @@ package main
 
 import (
 	"aria_module_universe"
+	"aria_utility_mqtt"
 	"aria_utility_settings"
 	"flag"
 	"fmt"
@@ -22,23 +23,40 @@ func main() {
 	settings := aria_utility_settings.LoadSettings(settingFileName)
 	os.Chdir(settings.RootPath)
 
+	// 組み込みMQTTブローカーの起動（他のプロセスのモジュールはここに接続する）
+	if settings.EmbeddedBrokerPort > 0 {
+		broker, err := aria_utility_mqtt.StartBroker(fmt.Sprintf(":%d", settings.EmbeddedBrokerPort), settings.MaxPacketSize)
+		if err != nil {
+			panic(err)
+		}
+		defer broker.Close()
+	}
+
 	// モジュール起動
 	var universeModule aria_module_universe.UniverseModule
 	universeModule.Initialize(settings).Wait()
 	defer universeModule.Uninitialize()
 
-	// 入力待ち
-	fmt.Scanln()
+	// 入力待ち（遠隔操作の場合は開始の要求を待つ）
+	if !universeModule.WaitStart() {
+		return
+	}
 
-	// サイクルを連続実行
-	for true {
+	// サイクルを連続実行（制限時間を超えて中止した場合、遠隔操作で停止した場合は終了）
+	for !universeModule.Aborted {
 		// 最初のサイクルをPublish
 		universeModule.PublishCycle().Wait()
 		for !universeModule.NeedsCycleStart {
 			stepStart := time.Now()
 			universeModule.PublishStep().Wait()
 			stepFinish := time.Now()
+			if universeModule.Aborted {
+				break
+			}
 			fmt.Printf("Step %3d Finished | %4d ms | Affected %4d | Evacuated %4d\n", universeModule.StepCount, stepFinish.Sub(stepStart).Milliseconds(), universeModule.Affected, universeModule.Evacuated)
+			if !universeModule.WaitStep() {
+				return
+			}
 		}
 	}
 }
@@ -4,6 +4,8 @@ go 1.16
 
 require (
 	aria_module_universe v0.0.0
+	aria_utility_mqtt v0.0.0
+	aria_utility_settings v0.0.0
 )
 
 replace aria_module_universe => ../../module/universe
@@ -1,7 +1,6 @@
 package aria_module_media
 
 import (
-	"encoding/json"
 	"fmt"
 	"sync"
 
@@ -13,14 +12,108 @@ import (
 )
 
 // Mediaモジュール
+// 配信がPotentialモジュールの次のステップより先に届くように、Personを持たないモジュールとしてステップに参加する
 type MediaModule struct {
-	client MQTT.Client
+	presence *aria_utility_mqtt.Presence
+	client   MQTT.Client
 }
 
 func (module *MediaModule) Initialize(settings aria_utility_settings.SettingEntity, potentialEntity aria_utility_settings.SettingPotentialEntity) *sync.WaitGroup {
 	syncer := sync.WaitGroup{}
 	syncer.Add(1)
 
+	topics := aria_utility_mqtt.NewTopics(settings.UniverseID, settings.LegacyTopics)
+	lastCount := -1        // 最後に処理したステップ
+	lastResult := []byte{} // 最後に処理したステップの完了通知
+	isPrepared := false    // サイクルの状態を持っている（再接続の場合）
+	isRegistered := false
+	encoding := aria_utility_mqtt.EncodingJSON // aria/persons/+で使うペイロードの形式（Universeが決める）
+	clientID := xid.New().String()
+	moduleID := clientID // モジュールID（Potentialモジュールの名前がある場合は、それに合わせて固定する）
+	if potentialEntity.ModuleName != "" {
+		moduleID = potentialEntity.ModuleName + "-media"
+	}
+
+	// シナリオ（サイクル毎のメディアの変更）
+	var scenario aria_utility_settings.ScenarioEntity
+	if settings.ScenarioFilePath != "" {
+		var err error
+		if scenario, err = aria_utility_settings.LoadScenario(settings); err != nil {
+			panic(err)
+		}
+	}
+	media := potentialEntity.Media // 現在のサイクルのメディア
+
+	// 準備完了をPublish
+	publishPrepared := func(client MQTT.Client, cycleCount int) {
+		if settings.ScenarioFilePath != "" {
+			media = scenario.Cycle(cycleCount).ApplyPotential(potentialEntity).Media
+		}
+		isPrepared = true
+		lastCount = -1
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.PreparedEntity{
+			ID: moduleID,
+		})
+		if token := client.Publish(topics.Prepared(), 0, false, bytes); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+	}
+
+	// 参加完了
+	var registeredRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.RegisteredEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+		encoding = entity.Encoding
+
+		// 再接続による再登録の場合は、初期化の完了を通知済み
+		if !isRegistered {
+			isRegistered = true
+			syncer.Done()
+		}
+	}
+
+	// サイクルの開始
+	var cycleRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CycleEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+		publishPrepared(client, entity.Cycle)
+	}
+
+	// チェックポイント（保存する状態はないので、完了だけ通知する）
+	var checkpointRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CheckpointEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+		if !isPrepared {
+			return
+		}
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.CheckpointedEntity{
+			ID:   moduleID,
+			Step: entity.Step,
+		})
+		if token := client.Publish(topics.Checkpointed(), 0, false, bytes); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+	}
+
+	// チェックポイントからの再開
+	var restoreRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CheckpointEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+		publishPrepared(client, entity.Cycle)
+	}
+
 	// ステップの開始
 	var countRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		if !module.client.IsConnected() {
@@ -28,12 +121,24 @@ func (module *MediaModule) Initialize(settings aria_utility_settings.SettingEnti
 		}
 
 		var entity aria_utility_mqtt.CountEntity
-		json.Unmarshal(msg.Payload(), &entity)
-		if entity.Count < 0 {
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
+		if entity.Count < 0 || !isPrepared {
 			return
 		}
 
-		for _, mediaEntity := range potentialEntity.Media {
+		// 再実行で同じステップが届いた場合は、重複して配信せずに完了通知だけを再送する
+		if entity.Count == lastCount {
+			if token := client.Publish(topics.Persons(), 0, false, lastResult); token.Wait() && token.Error() != nil {
+				panic(token.Error())
+			}
+			return
+		}
+		lastCount = entity.Count
+
+		for _, mediaEntity := range media {
 			currentStep := entity.Count - mediaEntity.Step
 			if 0 <= currentStep && currentStep <= mediaEntity.Duration {
 				entity := aria_utility_mqtt.MediaEntity{
@@ -43,34 +148,74 @@ func (module *MediaModule) Initialize(settings aria_utility_settings.SettingEnti
 					Acquisition: mediaEntity.Acquisition,
 					Type:        mediaEntity.Type,
 				}
-				bytes, _ := json.Marshal(entity)
-				if token := client.Publish(fmt.Sprintf("aria/media/%s", settings.UniverseID), 0, false, bytes); token.Wait() && token.Error() != nil {
+				bytes := aria_utility_mqtt.Encode(&entity)
+				if token := client.Publish(topics.Media(), 0, false, bytes); token.Wait() && token.Error() != nil {
 					panic(token.Error())
 				}
 			}
 		}
+
+		// 配信の後に完了をPublish（Universeは全ての配信が終わってから次のステップに進む）
+		lastResult = aria_utility_mqtt.EncodeStep(encoding, aria_utility_mqtt.StepEntity{
+			ID:      moduleID,
+			Count:   entity.Count,
+			Persons: []aria_utility_mqtt.AllEntity{},
+		})
+		if token := client.Publish(topics.Persons(), 0, false, lastResult); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
 	}
 
 	// MQTTクライアントの設定
-	opts := MQTT.NewClientOptions().AddBroker(settings.BrokerAddress).SetClientID(xid.New().String())
+	opts := MQTT.NewClientOptions().AddBroker(settings.BrokerAddress).SetClientID(clientID)
 	opts.OnConnect = func(client MQTT.Client) {
-		if token := client.Subscribe("/flood/count", 0, countRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Registered(moduleID), 0, registeredRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Cycle(), 0, cycleRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Count(), 0, countRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Checkpoint(), 0, checkpointRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Restore(), 0, restoreRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+
+		// Universeモジュールに参加をPublish（Personは持たない）
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.AttendEntity{
+			ID:        moduleID,
+			Count:     0,
+			Active:    isPrepared,
+			Session:   clientID,
+			Encodings: aria_utility_mqtt.Encodings,
+		})
+		if token := client.Publish(topics.Attend(), 0, false, bytes); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 		fmt.Printf("[Media] Initialized (%s)\n", opts.ClientID)
-		syncer.Done()
 	}
 
+	// 異常切断した場合は、ブローカーから離脱を通知してもらう
+	aria_utility_mqtt.SetLeaveWill(opts, topics, moduleID)
+
 	// MQTTブローカーに接続
-	module.client = MQTT.NewClient(opts)
+	module.client = aria_utility_mqtt.NewClient(settings.Transport, opts)
 	if token := module.client.Connect(); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
 
+	// 生存通知の開始
+	module.presence = aria_utility_mqtt.StartPresence(module.client, topics, moduleID, settings.HeartbeatInterval)
+
 	return &syncer
 }
 
 func (person *MediaModule) Uninitialize() {
+	person.presence.Leave()
 	person.client.Disconnect(250)
 	fmt.Println("[Media] Uninitialize")
 }
@@ -3,7 +3,6 @@ package aria_module_person
 import (
 	"aria_utility_settings"
 	"encoding/csv"
-	"encoding/json"
 	"fmt"
 	"io"
 	"math"
@@ -12,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"aria_utility_floods"
 	"aria_utility_mqtt"
@@ -37,6 +37,7 @@ type PersonData struct {
 	RequestTimeout int
 	RerouteTimeout int
 	Influence      int
+	Profile        string // 経路計算のプロファイル（15列目、空：設定ファイルのコスト）
 }
 
 // Personエージェント
@@ -54,14 +55,8 @@ type Person struct {
 	IsAnnounced    bool
 	RouteToLeader  []int
 	RouteToTop     []int
-}
-
-// 他のPersonモジュールも含めたPerson
-type PersonTemporary struct {
-	ID        int
-	NID       int   `json:"nid"`
-	Influence int   `json:"influence"`
-	Route     []int `json:"route"`
+	TargetReached  bool // 目的地（TargetNID）に着いた、または目的地が地図にない（以降は最寄りの避難場所に向かう）
+	Waiting        int  // 満員のリンクの入口で待っているステップ数（0：待っていない）
 }
 
 // Positionエージェント
@@ -77,7 +72,22 @@ type ViewPoint struct {
 	Length int
 }
 
+// チェックポイントに保存するPersonモジュールの状態
+type PersonCheckpoint struct {
+	AnnounceStep      int
+	Persons           map[int]*Person
+	PersonsInUniverse map[int]aria_utility_mqtt.IntraPersonEntity
+	QRFloods          map[string]Position
+	QRAntennas        map[string]Position
+	Events            aria_utility_nodes.MapEvents
+	Shelters          map[int]int
+}
+
+// 設定ファイルのRouteTimeoutが0の場合の時間（ミリ秒）
+const defaultRouteTimeout = 1000
+
 type PersonModule struct {
+	presence    *aria_utility_mqtt.Presence
 	client      MQTT.Client
 	Nodes       map[int]*aria_utility_nodes.NodeEntity
 	MapWidth    float64
@@ -109,9 +119,17 @@ func (module *PersonModule) Initialize(settings aria_utility_settings.SettingEnt
 	}
 
 	// 内部設定値
-	moduleID := ""
+	topics := aria_utility_mqtt.NewTopics(settings.UniverseID, settings.LegacyTopics)
+	moduleID := nodeEntity.ModuleName // モジュールID（再接続や再起動で同じIDの範囲を使う、離脱通知に使うので接続前に決める）
+	if moduleID == "" {
+		moduleID = xid.New().String()
+	}
+	isRegistered := false
+	encoding := aria_utility_mqtt.EncodingJSON // aria/persons/+で使うペイロードの形式（Universeが決める）
 	personIDFrom := 0
 	personIDTo := 0
+	lastCount := -1        // 最後に計算したステップ（再実行で同じステップが届いた場合に使う）
+	lastResult := []byte{} // 最後に計算したステップの結果
 	announceStep := 0
 
 	// 初期のパーソンの配列
@@ -120,8 +138,28 @@ func (module *PersonModule) Initialize(settings aria_utility_settings.SettingEnt
 	// パーソンの配列
 	var persons map[int]*Person
 
-	// 他のモジュールも含めたパーソンの配列
-	personsInUniverse := make(map[int]PersonTemporary)
+	// 他のモジュールも含めたパーソンの配列（交換フェーズで前ステップの状態が全て揃ってから更新する）
+	personsInUniverse := make(map[int]aria_utility_mqtt.IntraPersonEntity)
+
+	// 交換フェーズの状態
+	var exchange *aria_utility_mqtt.ExchangeEntity
+	isIntraPublished := false                                             // 自身の状態をPublish済みかどうか
+	intraBuffer := make(map[int]map[string]aria_utility_mqtt.IntraEntity) // ステップ毎に受信した他のモジュールの状態
+	pendingRoutes := make(map[int]bool)                                   // 応答を待っている経路要求（全て揃うまで交換フェーズを完了しない）
+	var routeTimer *time.Timer                                            // 応答を待つ期限（過ぎた場合は空の応答を自身に送る）
+
+	// 応答を待っている経路要求を捨てる
+	clearRoutes := func() {
+		pendingRoutes = make(map[int]bool)
+		if routeTimer != nil {
+			routeTimer.Stop()
+			routeTimer = nil
+		}
+	}
+
+	// 保存を待っているチェックポイント（経路要求の応答が全て揃ってから保存する）
+	var checkpoint *aria_utility_mqtt.CheckpointEntity
+	var checkpointMsg MQTT.Message
 
 	// QR洪水の座標一覧
 	var qrFloods map[string]Position = make(map[string]Position)
@@ -129,6 +167,34 @@ func (module *PersonModule) Initialize(settings aria_utility_settings.SettingEnt
 	// QRアンテナの座標一覧
 	var qrAntennas map[string]Position = make(map[string]Position)
 
+	// 避難場所毎の収容人数（Universeから受信した前ステップの全てのモジュールの人数に、このステップで受け入れた人数を加える）
+	shelters := make(map[int]int)
+
+	// 避難場所毎のこのモジュールのパーソンの人数（全ての避難場所と、閉鎖後もパーソンが残っているノード）
+	shelterResults := func() []aria_utility_mqtt.ShelterEntity {
+		occupancy := make(map[int]int)
+		for _, node := range module.Nodes {
+			if node.IsShelter {
+				occupancy[node.NID] = 0
+			}
+		}
+		for _, person := range persons {
+			if person.Status == 7 {
+				occupancy[person.NID]++
+			}
+		}
+		results := []aria_utility_mqtt.ShelterEntity{}
+		for nid, count := range occupancy {
+			results = append(results, aria_utility_mqtt.ShelterEntity{
+				NID:       nid,
+				Occupancy: count,
+				Capacity:  module.Nodes[nid].Capacity,
+			})
+		}
+		sort.Slice(results, func(i, j int) bool { return results[i].NID < results[j].NID })
+		return results
+	}
+
 	// 視野データの生成
 	viewPoints := []ViewPoint{}
 	for x := -10; x <= 10; x++ {
@@ -145,62 +211,43 @@ func (module *PersonModule) Initialize(settings aria_utility_settings.SettingEnt
 	}
 	sort.Slice(viewPoints, func(i, j int) bool { return viewPoints[i].Length < viewPoints[j].Length })
 
-	// パーソン設定ファイルの読込－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
+	// パーソン設定ファイルの読込
+	personDatas = module.loadPersonDatas(nodeEntity.PersonFilePath)
 
-	// ファイルを開く
-	file, _ := os.Open(nodeEntity.PersonFilePath)
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1
-
-	// 設定ファイルの内容を解析する
-	reader.Read()
-	for {
-		line, e := reader.Read()
-		if e == io.EOF {
-			break
+	// シナリオ（サイクル毎の地図、洪水、パーソンファイルの変更）
+	var scenario aria_utility_settings.ScenarioEntity
+	if settings.ScenarioFilePath != "" {
+		var err error
+		if scenario, err = aria_utility_settings.LoadScenario(settings); err != nil {
+			panic(err)
 		}
-
-		x, _ := strconv.ParseFloat(line[0], 64)
-		y, _ := strconv.ParseFloat(line[1], 64)
-		info, _ := strconv.Atoi(line[2])
-		prep, _ := strconv.Atoi(line[3])
-		speed, _ := strconv.ParseFloat(line[4], 64)
-		view, _ := strconv.Atoi(line[7])
-		warning, _ := strconv.ParseFloat(line[8], 64)
-		victim, _ := strconv.ParseFloat(line[9], 64)
-		target, _ := strconv.Atoi(line[10])
-		request, _ := strconv.Atoi(line[11])
-		reroute, _ := strconv.Atoi(line[12])
-		influence, _ := strconv.Atoi(line[13])
-
-		// 指定された座標から最も近い「ノード」にパーソンを配置する（実際の座標は無視している）
-		max := math.MaxFloat64
-		var current int
-		for _, node := range module.Nodes {
-			length := (x-node.X)*(x-node.X) + (y-node.Y)*(y-node.Y)
-			if length < max {
-				max = length
-				current = node.NID
+	}
+	cycleSettings := settings                   // 現在のサイクルの設定
+	personFilePath := nodeEntity.PersonFilePath // 現在のパーソンファイル
+	events := aria_utility_nodes.MapEvents{}    // サイクル中の地図の変更（サイクルの開始時に戻す）
+	applyCycle := func(cycleCount int) {
+		isChanged := len(events.Applied) > 0
+		events = aria_utility_nodes.MapEvents{}
+		if settings.ScenarioFilePath == "" {
+			if isChanged {
+				module.Nodes = aria_utility_nodes.LoadMap(settings, nodeEntity)
+			}
+			return
+		}
+		cycle := scenario.Cycle(cycleCount)
+		cycleSettings = cycle.Apply(settings)
+		module.Nodes = aria_utility_nodes.LoadScenarioMap(settings, nodeEntity, cycle)
+
+		// IDの範囲は参加した時に決まっているので、人数が違うファイルは使えない
+		if fileName := cycle.ApplyNode(nodeEntity).PersonFilePath; fileName != personFilePath {
+			if datas := module.loadPersonDatas(fileName); len(datas) == len(personDatas) {
+				personDatas = datas
+				personFilePath = fileName
+			} else {
+				fmt.Printf("[Person  ] Person File Ignored : %s (%d persons, %d expected)\n", fileName, len(datas), len(personDatas))
 			}
 		}
-
-		personDatas = append(personDatas, PersonData{
-			NID:            current,
-			X:              module.Nodes[current].X,
-			Y:              module.Nodes[current].Y,
-			InfoAccess:     info,
-			PrepareTimeout: prep,
-			Speed:          speed,
-			ViewLength:     view,
-			WarningDepth:   warning,
-			VictimDepth:    victim,
-			TargetNID:      target,
-			RequestTimeout: request,
-			RerouteTimeout: reroute,
-			Influence:      influence,
-		})
 	}
-	// －－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
 
 	// GPUの準備ここから－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
 
@@ -293,24 +340,39 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 	// パーソンエージェントの参加完了
 	var registeredRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.RegisteredEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 
 		personIDFrom = entity.From
 		personIDTo = entity.To
+		encoding = entity.Encoding
 		fmt.Printf("[Person  ] Registered : %s (%d to %d)\n", entity.ID, personIDFrom, personIDTo)
-		syncer.Done()
+
+		// 再接続による再登録の場合は、初期化の完了を通知済み
+		if !isRegistered {
+			isRegistered = true
+			syncer.Done()
+		}
 	}
 
 	// サイクルの開始
 	var cycleRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.CycleEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 
 		// 設定
 		announceStep = entity.AnnounceStep
+		applyCycle(entity.Cycle)
 
 		// パーソンの新規作成
 		persons = make(map[int]*Person)
+		shelters = make(map[int]int)
+		lastCount = -1
 		index := 0
 		for i := personIDFrom; i < personIDTo; i++ {
 			persons[i] = &Person{
@@ -327,22 +389,69 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 				IsAnnounced:    false,
 			}
 
-			// 最初から避難場所にいるパターン
-			if module.Nodes[persons[i].NID].IsShelter {
+			// 最初から避難場所にいるパターン（収容人数を超えた分はID順に外れる）
+			if node := module.Nodes[persons[i].NID]; node.IsOpen(shelters) {
 				persons[i].Status = 7
+				shelters[node.NID]++
 			}
 			index++
 		}
 
+		// 前のサイクルの交換状態を破棄
+		personsInUniverse = make(map[int]aria_utility_mqtt.IntraPersonEntity)
+		intraBuffer = make(map[int]map[string]aria_utility_mqtt.IntraEntity)
+		clearRoutes()
+		exchange = nil
+		isIntraPublished = false
+
 		// 準備完了をPublish
-		bytes, _ := json.Marshal(aria_utility_mqtt.PreparedEntity{
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.PreparedEntity{
 			ID: moduleID,
 		})
-		if token := client.Publish(fmt.Sprintf("aria/prepared/%s", settings.UniverseID), 0, false, bytes); token.Wait() && token.Error() != nil {
+		if token := client.Publish(topics.Prepared(), 0, false, bytes); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 	}
 
+	// 経路の途中で通れないリンク（通行止め）の手前までの経路（fromは経路の前のノード、通れない場合はtrue）
+	cutRoute := func(from int, route []int) ([]int, bool) {
+		for no, nid := range route {
+			node, exists := module.Nodes[from]
+			if !exists {
+				return route[:no], true
+			}
+			if _, exists := node.Link(nid); !exists {
+				return route[:no], true
+			}
+			from = nid
+		}
+		return route, false
+	}
+
+	// 地図の変更で通れなくなった経路を切り、経路を要求し直させる（通行止めのリンクの途中にいる場合は渡り切る）
+	cutClosedRoutes := func() {
+		for _, person := range persons {
+			person.RouteToTop, _ = cutRoute(person.NID, person.RouteToTop)
+			person.RouteToLeader, _ = cutRoute(person.NID, person.RouteToLeader)
+
+			crossing := 0
+			if person.WayToNode > 0 && len(person.Route) > 0 {
+				crossing = 1
+			}
+			from := person.NID
+			if crossing == 1 {
+				from = person.Route[0]
+			}
+			if _, isCut := cutRoute(from, person.Route[crossing:]); isCut {
+				person.Route = append([]int{}, person.Route[:crossing]...)
+				person.RerouteTimeout = 0
+				if person.Status == 3 || person.Status == 5 {
+					person.Status = 1
+				}
+			}
+		}
+	}
+
 	// ステップの開始
 	var countRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		if !module.client.IsConnected() {
@@ -350,13 +459,36 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 		}
 
 		var entity aria_utility_mqtt.CountEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 		if entity.Count < 0 {
 			return
 		}
 
+		// 最初のサイクルが始まるまで（サイクルの途中で参加した場合）は何もしない
+		if persons == nil {
+			return
+		}
+
+		// 再実行で同じステップが届いた場合は、計算せずに前回の結果を再送する
+		if entity.Count == lastCount {
+			if token := client.Publish(topics.Persons(), 0, false, lastResult); token.Wait() && token.Error() != nil {
+				panic(token.Error())
+			}
+			return
+		}
+
+		// 地図の変更の反映
+		applied := len(events.Applied)
+		events.Apply(module.Nodes, entity.Count)
+		if len(events.Applied) != applied {
+			cutClosedRoutes()
+		}
+
 		// 洪水情報の処理
-		module.Floods, _, _ = aria_utility_floods.LoadFloods(settings, module.FloodWidth, module.FloodHeight, entity.Count)
+		module.Floods, _, _ = aria_utility_floods.LoadFloods(cycleSettings, module.FloodWidth, module.FloodHeight, entity.Count)
 
 		// QR洪水の追加
 		for _, qrFlood := range qrFloods {
@@ -398,7 +530,14 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 				currentNeighbor++
 			}
 		}
-		for id, person := range personsInUniverse {
+		// 同じ影響力の場合はIDが小さいパーソンを優先する（受信順に依存させない）
+		universeIDs := make([]int, 0, len(personsInUniverse))
+		for id := range personsInUniverse {
+			universeIDs = append(universeIDs, id)
+		}
+		sort.Ints(universeIDs)
+		for _, id := range universeIDs {
+			person := personsInUniverse[id]
 			if nodeBuffer[person.NID*7+4] < int32(person.Influence) {
 				nodeBuffer[person.NID*7+3] = int32(id)
 				nodeBuffer[person.NID*7+4] = int32(person.Influence)
@@ -469,8 +608,68 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 			}
 		}
 
-		// 各パーソンの処理を実行
-		for id, person := range persons {
+		// 各パーソンの処理を実行（避難場所に受け入れる順が変わらないようにID順）
+		requests := []aria_utility_mqtt.RouteRequestEntity{} // このステップの経路要求（まとめてPublishする）
+		ids := make([]int, 0, len(persons))
+		for id := range persons {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+
+		// リンクの混雑（ステップの開始時に各リンクの途中にいる、全てのモジュールのパーソンの数）
+		movement := settings.Movement
+		linkDensity := make(map[int]int) // 歩く速さに使う（ステップの開始時の数）
+		linkPersons := make(map[int]int) // 入口での待ちに使う（このステップに入ったパーソンを加える）
+		linkQueued := make(map[int]int)  // 入口で待ち続けるパーソンの数
+		linkGranted := make(map[int]int) // 待っていたパーソンのうち、このステップにリンクに入れるもの（パーソンのID：リンクのID）
+		if movement.JamDensity > 0 {
+			countLink := func(nid int, route []int) {
+				if node, exists := module.Nodes[nid]; exists && len(route) > 0 {
+					if link, exists := node.Link(route[0]); exists {
+						linkDensity[link.LinkID]++
+						linkPersons[link.LinkID]++
+					}
+				}
+			}
+			for id, person := range personsInUniverse {
+				if _, exists := persons[id]; !exists && person.OnLink {
+					countLink(person.NID, person.Route)
+				}
+			}
+			waiting := []int{}
+			for _, id := range ids {
+				person := persons[id]
+				if person.Status == 6 || person.Status == 7 || len(person.Route) == 0 {
+					continue
+				}
+				if person.WayToNode > 0 {
+					countLink(person.NID, person.Route)
+				} else if person.Waiting > 0 {
+					waiting = append(waiting, id)
+				}
+			}
+
+			// 入口で待っているパーソンは、長く待っている順（同じ場合はID順）に空いた分だけ入れる
+			sort.SliceStable(waiting, func(i, j int) bool {
+				return persons[waiting[i]].Waiting > persons[waiting[j]].Waiting
+			})
+			for _, id := range waiting {
+				person := persons[id]
+				link, exists := module.Nodes[person.NID].Link(person.Route[0])
+				if !exists {
+					continue
+				}
+				if capacity := link.LinkCapacity(movement); capacity == 0 || linkPersons[link.LinkID] < capacity {
+					linkPersons[link.LinkID]++
+					linkGranted[id] = link.LinkID
+				} else {
+					linkQueued[link.LinkID]++
+				}
+			}
+		}
+
+		for _, id := range ids {
+			person := persons[id]
 
 			// 被災済み、または避難済みは、外部からの影響も受けない
 			if person.Status == 6 || person.Status == 7 {
@@ -555,14 +754,22 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 					person.Route = person.Route[:0]
 					person.RerouteTimeout = person.Data.RequestTimeout
 
-					// 経路要求をPublish
-					bytes, _ := json.Marshal(aria_utility_mqtt.RouteEntity{
+					// 経路要求を追加（目的地に着いた後は最寄りの避難場所）
+					if person.NID == person.Data.TargetNID {
+						person.TargetReached = true
+					}
+					targetNID := person.Data.TargetNID
+					if person.TargetReached {
+						targetNID = 0
+					}
+					requests = append(requests, aria_utility_mqtt.RouteRequestEntity{
+						ID:        id,
 						StartNID:  person.NID,
-						TargetNID: person.Data.TargetNID,
+						TargetNID: targetNID,
+						Speed:     person.Data.Speed,
+						Profile:   person.Data.Profile,
 					})
-					if token := client.Publish(fmt.Sprintf("/person/send/start2target/%d", id), 0, false, bytes); token.Wait() && token.Error() != nil {
-						panic(token.Error())
-					}
+					pendingRoutes[id] = true
 				}
 			}
 
@@ -572,53 +779,116 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 				person.Route = person.RouteToTop
 			}
 
-			// 移動
+			// 移動（remainingLengthは混雑していないリンクを歩ける距離）
+			isWaiting := false
 			if len(person.Route) > 0 {
 				remainingLength := person.Data.Speed
 				for remainingLength > 0 {
 					currentNode := module.Nodes[person.NID]
 					targetNode := module.Nodes[person.Route[0]]
-					nodeToNode := -1.0
 
 					// 次のノードが近隣にノードにあるか調べる
-					for _, neighbor := range currentNode.Neighbors {
-						if neighbor.Node.NID == person.Route[0] {
-							nodeToNode = neighbor.Length
+					link, exists := currentNode.Link(person.Route[0])
+					if !exists && person.WayToNode > 0 {
+						// 通行止めになったリンクの途中にいる場合は渡り切る
+						link, exists = currentNode.ClosedLink(person.Route[0])
+					}
+					if !exists {
+						// 次のノードに進めない場合（リーダーの経路が通行止めのリンクを通るなど）は、リンクの手前に戻って経路を要求し直す
+						if person.WayToNode > 0 {
+							person.X = currentNode.X
+							person.Y = currentNode.Y
+							person.WayToNode = 0
+						}
+						person.Route = []int{}
+						person.RerouteTimeout = 0
+						if person.Status == 3 || person.Status == 5 {
+							person.Status = 1
 						}
+						break
 					}
-					if nodeToNode == -1 {
-						panic("Target Node Is Not Neighbor")
+					nodeToNode := link.Length
+
+					// リンクの混雑（満員のリンクや、入口で待っているパーソンがいるリンクには入らない）
+					ratio := 1.0
+					if movement.JamDensity > 0 {
+						if person.WayToNode == 0 {
+							if granted, exists := linkGranted[id]; exists && granted == link.LinkID {
+								delete(linkGranted, id)
+							} else if capacity := link.LinkCapacity(movement); linkQueued[link.LinkID] > 0 || (capacity > 0 && linkPersons[link.LinkID] >= capacity) {
+								isWaiting = true
+								break
+							} else {
+								linkPersons[link.LinkID]++
+							}
+						}
+						ratio = link.SpeedRatio(movement, linkDensity[link.LinkID])
 					}
 
-					if person.WayToNode+remainingLength/nodeToNode >= 1.0 {
+					if person.WayToNode+remainingLength*ratio/nodeToNode >= 1.0 {
 
 						// 次のノードまで移動
 						person.NID = person.Route[0]
 						person.X = targetNode.X
 						person.Y = targetNode.Y
 						person.Route = person.Route[1:]
-						remainingLength -= nodeToNode * (1.0 - person.WayToNode)
+						remainingLength -= nodeToNode * (1.0 - person.WayToNode) / ratio
 						person.WayToNode = 0
 
 						// ゴール
+						// 満員の避難場所や避難場所でない目的地では、次のステップで避難場所への経路を要求する
 						if len(person.Route) == 0 {
-							if module.Nodes[person.NID].IsShelter {
+							isTarget := person.Data.TargetNID > 0 && person.NID == person.Data.TargetNID
+							if isTarget {
+								person.TargetReached = true
+							}
+							if node := module.Nodes[person.NID]; node.IsOpen(shelters) {
 								person.Status = 7
+								shelters[node.NID]++
 							} else {
 								person.Status = 1
+								if node.IsShelter || isTarget {
+									person.RerouteTimeout = 0
+								}
 							}
 							break
 						}
 					} else {
 
 						// ノードの途中まで移動
-						person.WayToNode = person.WayToNode + remainingLength/nodeToNode
+						person.WayToNode = person.WayToNode + remainingLength*ratio/nodeToNode
 						person.X = targetNode.X*person.WayToNode + currentNode.X*(1.0-person.WayToNode)
 						person.Y = targetNode.Y*person.WayToNode + currentNode.Y*(1.0-person.WayToNode)
 						remainingLength = 0
 					}
 				}
 			}
+			if isWaiting {
+				person.Waiting++
+			} else {
+				person.Waiting = 0
+			}
+		}
+
+		// 経路要求をまとめてPublish
+		if len(requests) > 0 {
+			bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.RouteBatchEntity{
+				Count:    entity.Count,
+				Requests: requests,
+			})
+			if token := client.Publish(topics.RouteBatchRequest(moduleID), 0, false, bytes); token.Wait() && token.Error() != nil {
+				panic(token.Error())
+			}
+
+			// 経路計算モジュールがない場合や応答が失われた場合は、RouteTimeout後に空の応答で要求を捨てる（要求したパーソンは次の再要求を待つ）
+			timeout := settings.RouteTimeout
+			if timeout == 0 {
+				timeout = defaultRouteTimeout
+			}
+			empty := aria_utility_mqtt.Encode(&aria_utility_mqtt.RouteBatchResultEntity{Count: entity.Count, Routes: []aria_utility_mqtt.RouteResultEntity{}})
+			routeTimer = time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+				client.Publish(topics.RouteBatchResponse(moduleID), 0, false, empty)
+			})
 		}
 
 		// 結果をPublish
@@ -633,60 +903,266 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 				InfoAccess: person.InfoAccess,
 			})
 		}
-		bytes, _ := json.Marshal(aria_utility_mqtt.StepEntity{
-			ID:      moduleID,
-			Persons: results,
+		bytes := aria_utility_mqtt.EncodeStep(encoding, aria_utility_mqtt.StepEntity{
+			ID:       moduleID,
+			Count:    entity.Count,
+			Persons:  results,
+			Shelters: shelterResults(),
 		})
-		if token := client.Publish(fmt.Sprintf("aria/persons/%s", settings.UniverseID), 0, false, bytes); token.Wait() && token.Error() != nil {
+		lastCount = entity.Count
+		lastResult = bytes
+		if token := client.Publish(topics.Persons(), 0, false, bytes); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
+	}
 
-		// TODO : 最終的にはどうにかしてAllと共通化するべき
-		// 結果を内部にPublish
-		results2 := []PersonTemporary{}
-		for id, person := range persons {
-			results2 = append(results2, PersonTemporary{
-				ID:        id,
-				NID:       person.NID,
-				Influence: person.Data.Influence,
-				Route:     person.Route,
-				// Z:         module.Nodes[person.NID].Height,
+	// 経路要求の応答が全て揃ったら自身の状態をPublishし、
+	// 交換対象の全てのモジュールの状態が揃っていれば、personsInUniverseを更新して交換完了をPublish
+	checkExchanged := func(client MQTT.Client) {
+		if exchange == nil || len(pendingRoutes) > 0 {
+			return
+		}
+		if !isIntraPublished {
+			isIntraPublished = true
+
+			// TODO : 最終的にはどうにかしてAllと共通化するべき
+			// 結果を内部にPublish
+			results := []aria_utility_mqtt.IntraPersonEntity{}
+			for id, person := range persons {
+				results = append(results, aria_utility_mqtt.IntraPersonEntity{
+					ID:        id,
+					NID:       person.NID,
+					Influence: person.Data.Influence,
+					Route:     person.Route,
+					OnLink:    person.WayToNode > 0 && len(person.Route) > 0 && person.Status != 6 && person.Status != 7,
+					// Z:         module.Nodes[person.NID].Height,
+				})
+			}
+			bytes := aria_utility_mqtt.EncodeIntra(exchange.Encoding, aria_utility_mqtt.IntraEntity{
+				ID:      moduleID,
+				Count:   exchange.Count,
+				Persons: results,
 			})
+			if token := client.Publish(topics.Intra(), 0, false, bytes); token.Wait() && token.Error() != nil {
+				panic(token.Error())
+			}
+		}
+
+		// 全てのモジュールの状態が揃うまで待つ
+		received := intraBuffer[exchange.Count]
+		for _, id := range exchange.Modules {
+			if _, exists := received[id]; !exists {
+				return
+			}
+		}
+
+		personsInUniverse = make(map[int]aria_utility_mqtt.IntraPersonEntity)
+		for _, id := range exchange.Modules {
+			for _, person := range received[id].Persons {
+				personsInUniverse[person.ID] = person
+			}
+		}
+		for count := range intraBuffer {
+			if count <= exchange.Count {
+				delete(intraBuffer, count)
+			}
+		}
+
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.ExchangedEntity{
+			ID:    moduleID,
+			Count: exchange.Count,
+		})
+		exchange = nil
+		if token := client.Publish(topics.Exchanged(), 0, false, bytes); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+	}
+
+	// 経路要求の応答が全て揃っていれば、状態を保存して保存完了をPublish
+	checkCheckpoint := func(client MQTT.Client) {
+		if checkpoint == nil || len(pendingRoutes) > 0 {
+			return
+		}
+		entity := checkpoint
+		checkpoint = nil
+
+		err := aria_utility_mqtt.SaveCheckpoint(entity.Path, moduleID, PersonCheckpoint{
+			AnnounceStep:      announceStep,
+			Persons:           persons,
+			PersonsInUniverse: personsInUniverse,
+			QRFloods:          qrFloods,
+			QRAntennas:        qrAntennas,
+			Events:            events,
+			Shelters:          shelters,
+		})
+		if err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, checkpointMsg, err)
+			return
 		}
-		bytes2, _ := json.Marshal(results2)
-		if token := client.Publish(fmt.Sprintf("aria/intra/persons/%s", settings.UniverseID), 0, false, bytes2); token.Wait() && token.Error() != nil {
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.CheckpointedEntity{
+			ID:   moduleID,
+			Step: entity.Step,
+		})
+		if token := client.Publish(topics.Checkpointed(), 0, false, bytes); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 	}
 
-	// ルーティングの完了
-	var routedRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
-		var entity []string
-		json.Unmarshal(msg.Payload(), &entity)
+	// 経路が見つからなかった理由に応じた行動（理由がない場合や分からない場合は、RerouteTimeoutまで待つ）
+	routeFailed := func(person *Person, failure aria_utility_mqtt.RouteFailureEntity) {
+		switch failure.Reason {
+		case aria_utility_mqtt.RouteUnreachable, aria_utility_mqtt.RouteStartFlooded:
+			// 高所があれば、次のステップから高所に向かう
+			if len(person.RouteToTop) > 0 {
+				person.Status = 4
+			}
+		case aria_utility_mqtt.RouteUnknownNode:
+			// 目的地が地図にない場合は、次のステップで最寄りの避難場所を要求し直す
+			if failure.NID == person.Data.TargetNID && failure.NID != person.NID {
+				person.TargetReached = true
+				person.RerouteTimeout = 0
+			}
+		}
+	}
 
-		// PersonのIDを解析
-		id, _ := strconv.Atoi(strings.Split(msg.Topic(), "/")[len(strings.Split(msg.Topic(), "/"))-1])
+	// ルーティングの完了（要求と同じ順の経路、応答を受信したら全ての要求を完了とする）
+	var routesRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.RouteBatchResultEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 
-		// Personが存在する場合は処理
-		if person, exists := persons[id]; exists {
+		// 前のステップの要求への遅れた応答は、現在のステップの要求を完了させない
+		if entity.Count != lastCount {
+			return
+		}
 
-			// 受信済みであれば無視する
-			if len(person.Route) == 0 {
+		for _, result := range entity.Routes {
+			person, exists := persons[result.ID]
+			if !exists || !pendingRoutes[result.ID] {
+				continue
+			}
 
-				// ルートを追加
-				for _, node := range entity {
-					nid, _ := strconv.Atoi(node)
-					person.Route = append(person.Route, nid)
+			// 経路が見つからなかった場合
+			if len(result.Route) == 0 {
+				if result.Reason != "" && person.Status == 2 {
+					routeFailed(person, aria_utility_mqtt.RouteFailureEntity{Reason: result.Reason, NID: result.NID})
 				}
+				continue
+			}
 
-				// 起点がずれた受信は無視する
-				if len(person.Route) > 0 && person.NID != person.Route[0] {
-					person.Route = person.Route[:0]
-				} else {
-					person.Status = 3
-					person.Route = person.Route[1:]
-					person.RerouteTimeout = person.Data.RerouteTimeout
-				}
+			// 起点がずれた受信は無視する
+			if len(person.Route) == 0 && person.NID == result.Route[0] {
+				person.Status = 3
+				person.Route = append(person.Route, result.Route[1:]...)
+				person.RerouteTimeout = person.Data.RerouteTimeout
+			}
+		}
+		clearRoutes()
+		checkExchanged(client)
+		checkCheckpoint(client)
+	}
+
+	// チェックポイント（次のステップの開始前の状態を保存）
+	var checkpointRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CheckpointEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+
+		// 最初のサイクルが始まるまで（サイクルの途中で参加した場合）は何もしない
+		if persons == nil {
+			return
+		}
+		checkpoint = &entity
+		checkpointMsg = msg
+		checkCheckpoint(client)
+	}
+
+	// チェックポイントからの再開（サイクルの開始の代わりに状態を読み込む）
+	var restoreRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CheckpointEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+
+		var state PersonCheckpoint
+		if err := aria_utility_mqtt.LoadCheckpoint(entity.Path, moduleID, &state); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+
+		// 保存した時と同じIDの範囲が割り当てられていなければ再開できない
+		isSameRange := len(state.Persons) == personIDTo-personIDFrom
+		for i := personIDFrom; i < personIDTo && isSameRange; i++ {
+			_, isSameRange = state.Persons[i]
+		}
+		if !isSameRange {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, fmt.Errorf("checkpoint of %s does not match persons %d to %d", moduleID, personIDFrom, personIDTo))
+			return
+		}
+
+		announceStep = state.AnnounceStep
+		applyCycle(entity.Cycle)
+		events = state.Events
+		events.Reapply(module.Nodes)
+		persons = state.Persons
+		personsInUniverse = state.PersonsInUniverse
+		qrFloods = state.QRFloods
+		qrAntennas = state.QRAntennas
+		shelters = state.Shelters
+		if shelters == nil {
+			shelters = make(map[int]int)
+		}
+		lastCount = -1
+
+		// 交換状態を破棄
+		intraBuffer = make(map[int]map[string]aria_utility_mqtt.IntraEntity)
+		clearRoutes()
+		exchange = nil
+		isIntraPublished = false
+		checkpoint = nil
+		fmt.Printf("[Person  ] Restored : %s (Cycle %d Step %d)\n", moduleID, entity.Cycle, entity.Step)
+
+		// 準備完了をPublish
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.PreparedEntity{
+			ID: moduleID,
+		})
+		if token := client.Publish(topics.Prepared(), 0, false, bytes); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+	}
+
+	// 地図の変更の受信（ステップの開始時に反映する）
+	var eventRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.EventEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+		event := aria_utility_nodes.MapEvent{Step: entity.Step, Type: entity.Type, Target: entity.Target}
+		if err := aria_utility_nodes.ValidateEvent(module.Nodes, event); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+		events.Add(event)
+	}
+
+	// 避難場所の収容人数を受信（ステップの完了時にUniverseが全てのモジュールの人数を集計する）
+	var sheltersRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.SheltersEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+
+		shelters = make(map[int]int)
+		for _, shelter := range entity.Shelters {
+			if shelter.Map == "" {
+				shelters[shelter.NID] = shelter.Occupancy
 			}
 		}
 	}
@@ -694,7 +1170,10 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 	// QR洪水の情報を受信
 	var qrFloodRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.CameraEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 
 		x := float64(entity.X-entity.Left) * module.MapWidth / float64(entity.Right-entity.Left)
 		y := float64(entity.Y-entity.Top) * module.MapHeight / float64(entity.Bottom-entity.Top)
@@ -712,7 +1191,10 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 	// QRアンテナの情報を受信
 	var qrAntennaRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.CameraEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 
 		x := float64(entity.X-entity.Left) * module.MapWidth / float64(entity.Right-entity.Left)
 		y := float64(entity.Y-entity.Top) * module.MapHeight / float64(entity.Bottom-entity.Top)
@@ -730,7 +1212,10 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 	// メッセージを受信
 	var messageRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.MessageEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 
 		for _, target := range entity.Persons {
 			if _, ok := persons[target.ID]; ok {
@@ -764,74 +1249,126 @@ kernel void calc(global int* tasks, global int* froms, global int* persons, glob
 		}
 	}
 
-	// パーソンエージェントのステップ完了メッセージを受信
+	// 交換フェーズの開始（前ステップの結果を他のモジュールにPublish）
+	var exchangeRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.ExchangeEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+
+		// 交換対象でなければ何もしない（サイクルの途中で参加したモジュールなど）
+		isTarget := false
+		for _, id := range entity.Modules {
+			if id == moduleID {
+				isTarget = true
+			}
+		}
+		if !isTarget || persons == nil {
+			return
+		}
+		exchange = &entity
+		isIntraPublished = false
+
+		// 経路要求の応答が揃っていれば、自身の状態をPublish
+		checkExchanged(client)
+	}
+
+	// 他のモジュール（自身を含む）の前ステップの状態を受信
 	var intraRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
-		var entity []PersonTemporary
-		json.Unmarshal(msg.Payload(), &entity)
+		entity, err := aria_utility_mqtt.DecodeIntra(msg.Payload())
+		if err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 
-		// パーソンエージェントを追加
-		for _, person := range entity {
-			personsInUniverse[person.ID] = person
+		// 交換フェーズの開始より先に届くことがあるので、ステップ毎に保持しておく
+		if _, exists := intraBuffer[entity.Count]; !exists {
+			intraBuffer[entity.Count] = make(map[string]aria_utility_mqtt.IntraEntity)
 		}
+		intraBuffer[entity.Count][entity.ID] = entity
 
-		// TODO : 確実に待たせる実装が必要かも
+		checkExchanged(client)
 	}
 
 	// MQTTクライアントの設定
 	opts := MQTT.NewClientOptions().AddBroker(settings.BrokerAddress).SetClientID(xid.New().String())
 	opts.OnConnect = func(client MQTT.Client) {
 
-		// モジュールIDをランダムに設定
-		moduleID = xid.New().String()
-
 		// MQTTのサブスクライブ
-		if token := client.Subscribe(fmt.Sprintf("aria/registered/%s/%s", settings.UniverseID, moduleID), 0, registeredRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Registered(moduleID), 0, registeredRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Cycle(), 0, cycleRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Count(), 0, countRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.RouteBatchResponse(moduleID), 0, routesRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.CameraFlood("+"), 0, qrFloodRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Event(), 0, eventRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe(fmt.Sprintf("aria/cycle/%s", settings.UniverseID), 0, cycleRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Shelters(), 0, sheltersRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe("/flood/count", 0, countRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.CameraAntenna("+"), 0, qrAntennaRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe("/person/recv/start2target/+", 0, routedRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Message(), 0, messageRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe("/camera/flood/+", 0, qrFloodRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Intra(), 0, intraRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe("/camera/antenna/+", 0, qrAntennaRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Exchange(), 0, exchangeRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe(fmt.Sprintf("aria/message/%s", settings.UniverseID), 0, messageRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Checkpoint(), 0, checkpointRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe(fmt.Sprintf("aria/intra/persons/%s", settings.UniverseID), 0, intraRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Restore(), 0, restoreRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 
 		// Universeモジュールに参加をPublish
-		bytes, _ := json.Marshal(aria_utility_mqtt.AttendEntity{
-			ID:    moduleID,
-			Count: len(personDatas),
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.AttendEntity{
+			ID:        moduleID,
+			Count:     len(personDatas),
+			Exchange:  true,
+			Active:    persons != nil,
+			Session:   opts.ClientID,
+			Encodings: aria_utility_mqtt.Encodings,
 		})
-		if token := client.Publish(fmt.Sprintf("aria/attend/%s", settings.UniverseID), 0, false, bytes); token.Wait() && token.Error() != nil {
+		if token := client.Publish(topics.Attend(), 0, false, bytes); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 
 		fmt.Printf("[Person  ] Initialized (%s)\n", opts.ClientID)
 	}
 
+	// 異常切断した場合は、ブローカーから離脱を通知してもらう
+	aria_utility_mqtt.SetLeaveWill(opts, topics, moduleID)
+
 	// MQTTブローカーに接続
-	module.client = MQTT.NewClient(opts)
+	module.client = aria_utility_mqtt.NewClient(settings.Transport, opts)
 	if token := module.client.Connect(); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
 
+	// 生存通知の開始
+	module.presence = aria_utility_mqtt.StartPresence(module.client, topics, moduleID, settings.HeartbeatInterval)
+
 	return &syncer
 }
 
 func (person *PersonModule) Uninitialize() {
+	person.presence.Leave()
 	person.client.Disconnect(250)
 	fmt.Println("[Person  ] Uninitialize")
 }
@@ -930,3 +1467,69 @@ func CreateBuffer(context opencl.Context, kernel opencl.Kernel, index uint32, si
 	}
 	return buffer
 }
+
+// パーソン設定ファイルの読込（パーソンは最も近いノードに配置する）
+func (module *PersonModule) loadPersonDatas(fileName string) []PersonData {
+	personDatas := []PersonData{}
+
+	// ファイルを開く
+	file, _ := os.Open(fileName)
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	// 設定ファイルの内容を解析する
+	reader.Read()
+	for {
+		line, e := reader.Read()
+		if e == io.EOF {
+			break
+		}
+
+		x, _ := strconv.ParseFloat(line[0], 64)
+		y, _ := strconv.ParseFloat(line[1], 64)
+		info, _ := strconv.Atoi(line[2])
+		prep, _ := strconv.Atoi(line[3])
+		speed, _ := strconv.ParseFloat(line[4], 64)
+		view, _ := strconv.Atoi(line[7])
+		warning, _ := strconv.ParseFloat(line[8], 64)
+		victim, _ := strconv.ParseFloat(line[9], 64)
+		target, _ := strconv.Atoi(line[10])
+		request, _ := strconv.Atoi(line[11])
+		reroute, _ := strconv.Atoi(line[12])
+		influence, _ := strconv.Atoi(line[13])
+		profile := ""
+		if len(line) > 14 {
+			profile = line[14]
+		}
+
+		// 指定された座標から最も近い「ノード」にパーソンを配置する（実際の座標は無視している）
+		max := math.MaxFloat64
+		var current int
+		for _, node := range module.Nodes {
+			length := (x-node.X)*(x-node.X) + (y-node.Y)*(y-node.Y)
+			if length < max || (length == max && node.NID < current) {
+				max = length
+				current = node.NID
+			}
+		}
+
+		personDatas = append(personDatas, PersonData{
+			NID:            current,
+			X:              module.Nodes[current].X,
+			Y:              module.Nodes[current].Y,
+			InfoAccess:     info,
+			PrepareTimeout: prep,
+			Speed:          speed,
+			ViewLength:     view,
+			WarningDepth:   warning,
+			VictimDepth:    victim,
+			TargetNID:      target,
+			RequestTimeout: request,
+			RerouteTimeout: reroute,
+			Influence:      influence,
+			Profile:        profile,
+		})
+	}
+	return personDatas
+}
@@ -9,8 +9,10 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"aria_utility_mqtt"
 	"aria_utility_settings"
@@ -42,6 +44,21 @@ type Person struct {
 	Data        PersonData
 }
 
+// チェックポイントに保存するPotentialモジュールの状態
+type PotentialCheckpoint struct {
+	Persons     map[int]*Person
+	RandomSeed  int64
+	RandomDraws int
+	Shelters    map[string]int
+}
+
+// ポテンシャルの避難場所（IsShelterの外的要因マップ毎に1つ）
+type PotentialShelter struct {
+	Map       string      // 外的要因マップのFilePath
+	Capacity  int         // 収容人数（0：無制限）
+	Potential [][]float64 // この避難場所が外的要因マップに加えたポテンシャル（満員の場合は差し引く）
+}
+
 // JSON形式のポテンシャルマップのファイルエンティティ
 type PotentialJsonEntity struct {
 	X         int     `json:"X"`
@@ -52,35 +69,47 @@ type PotentialJsonEntity struct {
 
 // Potentialモジュール
 type PotentialModule struct {
+	presence       *aria_utility_mqtt.Presence
 	client         MQTT.Client
-	PotentialMap   [][]float64   // ポテンシャルマップ（1/3）：外的要因マップ（１枚）
-	DisasterMaps   [][][]float64 // ポテンシャルマップ（2/3）：災害要因マップ（複数）
-	InternalMap    []float32     // ポテンシャルマップ（3/3）：内的要因マップ（パーソン毎）
-	DisasterLabels [][]int       // 対象の時間に考慮するマップ
-	ObjectMap      [][]int       // 壁(1)と避難所(2)を保持するマップ（衝突判定のために必要）
-	ResultMap      [][]float64   // 最終的なポテンシャルマップ（画面出力を考えないのであれば不要）
+	PotentialMap   [][]float64        // ポテンシャルマップ（1/3）：外的要因マップ（１枚）
+	DisasterMaps   [][][]float64      // ポテンシャルマップ（2/3）：災害要因マップ（複数）
+	InternalMap    []float32          // ポテンシャルマップ（3/3）：内的要因マップ（パーソン毎）
+	DisasterLabels [][]int            // 対象の時間に考慮するマップ
+	ObjectMap      [][]int            // 壁(1)と避難所(2)を保持するマップ（衝突判定のために必要）
+	ShelterMap     [][]int            // 避難所(2)のマスの避難場所（Sheltersの番号+1、避難所以外は0）
+	Shelters       []PotentialShelter // 避難場所（IsShelterの外的要因マップ毎）
+	ResultMap      [][]float64        // 最終的なポテンシャルマップ（画面出力を考えないのであれば不要）
 }
 
 func (module *PotentialModule) Initialize(settings aria_utility_settings.SettingEntity, potentialEntity aria_utility_settings.SettingPotentialEntity) *sync.WaitGroup {
 	syncer := sync.WaitGroup{}
 	syncer.Add(1)
 
-	universeID := settings.UniverseID
+	topics := aria_utility_mqtt.NewTopics(settings.UniverseID, settings.LegacyTopics)
 	settingMesh := potentialEntity.MeshSize
 
 	// 内部設定値
-	moduleID := ""
+	moduleID := potentialEntity.ModuleName // モジュールID（再接続や再起動で同じIDの範囲を使う、離脱通知に使うので接続前に決める）
+	if moduleID == "" {
+		moduleID = xid.New().String()
+	}
+	isRegistered := false
+	encoding := aria_utility_mqtt.EncodingJSON // aria/persons/+で使うペイロードの形式（Universeが決める）
 	personIDFrom := 0
 	personIDTo := 0
+	lastCount := -1        // 最後に計算したステップ（再実行で同じステップが届いた場合に使う）
+	lastResult := []byte{} // 最後に計算したステップの結果
 	mapWidth := int(math.Ceil(settings.MapWidth / settingMesh))
 	mapHeight := int(math.Ceil(settings.MapHeight / settingMesh))
 
 	// 外的要因ポテンシャルマップの初期化
 	module.PotentialMap = make([][]float64, mapWidth)
 	module.ObjectMap = make([][]int, mapWidth)
+	module.ShelterMap = make([][]int, mapWidth)
 	for x := 0; x < mapWidth; x++ {
 		module.PotentialMap[x] = make([]float64, mapHeight)
 		module.ObjectMap[x] = make([]int, mapHeight)
+		module.ShelterMap[x] = make([]int, mapHeight)
 		for y := 0; y < mapHeight; y++ {
 			module.PotentialMap[x][y] = 0.0
 			module.ObjectMap[x][y] = 0
@@ -93,6 +122,13 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 			if buffer, err := ioutil.ReadFile(externalEntity.FilePath); err == nil {
 				var externalPotentialJson []PotentialJsonEntity
 				json.Unmarshal(buffer, &externalPotentialJson)
+				var shelterPotential [][]float64
+				if externalEntity.IsShelter {
+					shelterPotential = make([][]float64, mapWidth)
+					for x := 0; x < mapWidth; x++ {
+						shelterPotential[x] = make([]float64, mapHeight)
+					}
+				}
 				for x := 0; x < mapWidth; x++ {
 					for y := 0; y < mapHeight; y++ {
 						maxValue := 0.0
@@ -106,6 +142,9 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 							}
 						}
 						module.PotentialMap[x][y] += maxValue
+						if shelterPotential != nil {
+							shelterPotential[x][y] = maxValue
+						}
 					}
 				}
 				if externalEntity.IsWall {
@@ -114,8 +153,14 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 					}
 				}
 				if externalEntity.IsShelter {
+					module.Shelters = append(module.Shelters, PotentialShelter{
+						Map:       externalEntity.FilePath,
+						Capacity:  externalEntity.Capacity,
+						Potential: shelterPotential,
+					})
 					for _, item := range externalPotentialJson {
 						module.ObjectMap[int(float64(item.X)/settingMesh)][int(float64(item.Y)/settingMesh)] = 2
+						module.ShelterMap[int(float64(item.X)/settingMesh)][int(float64(item.Y)/settingMesh)] = len(module.Shelters)
 					}
 				}
 			}
@@ -187,40 +232,37 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 	// パーソンの配列
 	var persons map[int]*Person
 
-	// パーソン設定ファイルの読込－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
+	// パーソン設定ファイルの読込
+	personDatas = loadPersonDatas(potentialEntity.PersonFilePath, settingMesh)
 
-	// ファイルを開く
-	file, _ := os.Open(potentialEntity.PersonFilePath)
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1
-
-	// 設定ファイルの内容を解析する
-	reader.Read()
-	for {
-		line, e := reader.Read()
-		if e == io.EOF {
-			break
+	// シナリオ（サイクル毎のパーソンファイルの変更、IDの範囲は参加した時に決まっているので人数は同じ）
+	var scenario aria_utility_settings.ScenarioEntity
+	if settings.ScenarioFilePath != "" {
+		var err error
+		if scenario, err = aria_utility_settings.LoadScenario(settings); err != nil {
+			panic(err)
 		}
-
-		x, _ := strconv.Atoi(line[0])
-		y, _ := strconv.Atoi(line[1])
-		prepareTime, _ := strconv.Atoi(line[3])
-		speed, _ := strconv.ParseFloat(line[4], 64)
-		acquisition := 1.0
-		if len(line) > 14 {
-			acquisition, _ = strconv.ParseFloat(line[14], 64)
+	}
+	personFilePath := potentialEntity.PersonFilePath // 現在のパーソンファイル
+
+	// 避難場所毎の収容人数（Universeから受信した前ステップの全てのモジュールの人数に、このステップで受け入れた人数を加える）
+	shelters := make(map[string]int)
+
+	// 避難場所毎のこのモジュールのパーソンの人数
+	shelterResults := func() []aria_utility_mqtt.ShelterEntity {
+		results := make([]aria_utility_mqtt.ShelterEntity, len(module.Shelters))
+		for no, shelter := range module.Shelters {
+			results[no] = aria_utility_mqtt.ShelterEntity{
+				Map:      shelter.Map,
+				Capacity: shelter.Capacity,
+			}
 		}
-
-		// パーソンの生成
-		personData := PersonData{
-			X:           int(float64(x) / settingMesh),
-			Y:           int(float64(y) / settingMesh),
-			PrepareTime: prepareTime,
-			Speed:       float32(speed / settingMesh),
-			Alpha:       1.0 / 128.0,
-			Acquisition: acquisition,
+		for _, person := range persons {
+			if no := module.ShelterMap[person.X][person.Y] - 1; person.Status == 7 && no >= 0 {
+				results[no].Occupancy++
+			}
 		}
-		personDatas = append(personDatas, personData)
+		return results
 	}
 
 	// 内的要因マップ
@@ -256,24 +298,64 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 	fmt.Printf("\n")
 	// －－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
 
+	// 乱数（チェックポイントから再開した時に同じ系列を続けられるように、シードと使用回数を保持する）
+	// シードを指定した場合は、参加した時に割り当てられたIDの範囲でモジュール毎に変える
+	randomSeed := time.Now().UnixNano()
+	randomDraws := 0
+	random := rand.New(rand.NewSource(randomSeed))
+	randomFloat := func() float64 {
+		randomDraws++
+		return random.Float64()
+	}
+
 	// パーソンエージェントの参加完了
 	var registeredRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.RegisteredEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 
 		personIDFrom = entity.From
 		personIDTo = entity.To
+		encoding = entity.Encoding
 		fmt.Printf("[Potential] Registered : %s (%d to %d)\n", entity.ID, personIDFrom, personIDTo)
-		syncer.Done()
+
+		// 再接続による再登録の場合は、初期化の完了を通知済み
+		if !isRegistered {
+			isRegistered = true
+			if settings.Seed != 0 {
+				randomSeed = settings.Seed + int64(personIDFrom)
+				random = rand.New(rand.NewSource(randomSeed))
+			}
+			syncer.Done()
+		}
 	}
 
 	// サイクルの開始
 	var cycleRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.CycleEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+
+		// シナリオのパーソンファイルに切り替える
+		if settings.ScenarioFilePath != "" {
+			if fileName := scenario.Cycle(entity.Cycle).ApplyPotential(potentialEntity).PersonFilePath; fileName != personFilePath {
+				if datas := loadPersonDatas(fileName, settingMesh); len(datas) == len(personDatas) {
+					personDatas = datas
+					personFilePath = fileName
+				} else {
+					fmt.Printf("[Potential] Person File Ignored : %s (%d persons, %d expected)\n", fileName, len(datas), len(personDatas))
+				}
+			}
+		}
 
 		// パーソンの新規作成
 		persons = make(map[int]*Person)
+		shelters = make(map[string]int)
+		lastCount = -1
 		index := 0
 		for i := personIDFrom; i < personIDTo; i++ {
 			persons[i] = &Person{
@@ -302,11 +384,11 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 				InfoAccess: 0,
 			})
 		}
-		bytes, _ := json.Marshal(aria_utility_mqtt.PreparedEntity{
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.PreparedEntity{
 			ID:      moduleID,
 			Persons: results,
 		})
-		if token := client.Publish(fmt.Sprintf("aria/prepared/%s", universeID), 0, false, bytes); token.Wait() && token.Error() != nil {
+		if token := client.Publish(topics.Prepared(), 0, false, bytes); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 	}
@@ -318,11 +400,27 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 		}
 
 		var entity aria_utility_mqtt.CountEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 		if entity.Count < 0 {
 			return
 		}
 
+		// 最初のサイクルが始まるまで（サイクルの途中で参加した場合）は何もしない
+		if persons == nil {
+			return
+		}
+
+		// 再実行で同じステップが届いた場合は、計算せずに前回の結果を再送する
+		if entity.Count == lastCount {
+			if token := client.Publish(topics.Persons(), 0, false, lastResult); token.Wait() && token.Error() != nil {
+				panic(token.Error())
+			}
+			return
+		}
+
 		// 現在の災害マップ、描画用マップ
 		for x := 0; x < mapWidth; x++ {
 			for y := 0; y < mapHeight; y++ {
@@ -374,6 +472,20 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 				personCounts[person.Y*mapWidth+person.X]++
 			}
 		}
+		// 満員の避難場所は入れないようにして、引き寄せるポテンシャルも外す（別の避難場所に向かう）
+		for no, shelter := range module.Shelters {
+			if shelter.Capacity == 0 || shelters[shelter.Map] < shelter.Capacity {
+				continue
+			}
+			for x := 0; x < mapWidth; x++ {
+				for y := 0; y < mapHeight; y++ {
+					if module.ShelterMap[x][y] == no+1 && objects[y*mapWidth+x] == 2 {
+						objects[y*mapWidth+x] = 1
+					}
+					potentials[y*mapWidth+x] -= float32(shelter.Potential[x][y])
+				}
+			}
+		}
 		// TODO : ステップ開始時点での人数で入場禁止を決めるので、一時的に４人以上が入る可能性がある
 		for i := 0; i < mapWidth*mapHeight; i++ {
 			if objects[i] == 0 && personCounts[i] >= 4 {
@@ -386,6 +498,29 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 			search(int32(index), int32(mapWidth), int32(mapHeight), personValues, personParams, potentials, module.InternalMap, objects)
 		}
 
+		// 避難所に着いたパーソンをID順に受け入れ、収容人数を超えた場合は元の位置に戻す
+		ids := make([]int, 0, len(persons))
+		for id := range persons {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, index := range ids {
+			person := persons[index]
+			x := int(personValues[index*4+0])
+			y := int(personValues[index*4+1])
+			no := module.ShelterMap[x][y] - 1
+			if person.Status == 7 || personValues[index*4+3] != 7 || no < 0 {
+				continue
+			}
+			if shelter := module.Shelters[no]; shelter.Capacity > 0 && shelters[shelter.Map] >= shelter.Capacity {
+				personValues[index*4+0] = int32(person.X)
+				personValues[index*4+1] = int32(person.Y)
+				personValues[index*4+3] = 3
+				continue
+			}
+			shelters[module.Shelters[no].Map]++
+		}
+
 		for index, person := range persons {
 			person.X = int(personValues[index*4+0])
 			person.Y = int(personValues[index*4+1])
@@ -409,11 +544,15 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 				InfoAccess: 0,
 			})
 		}
-		bytes, _ := json.Marshal(aria_utility_mqtt.StepEntity{
-			ID:      moduleID,
-			Persons: results,
+		bytes := aria_utility_mqtt.EncodeStep(encoding, aria_utility_mqtt.StepEntity{
+			ID:       moduleID,
+			Count:    entity.Count,
+			Persons:  results,
+			Shelters: shelterResults(),
 		})
-		if token := client.Publish(fmt.Sprintf("aria/persons/%s", universeID), 0, false, bytes); token.Wait() && token.Error() != nil {
+		lastCount = entity.Count
+		lastResult = bytes
+		if token := client.Publish(topics.Persons(), 0, false, bytes); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 	}
@@ -425,59 +564,180 @@ func (module *PotentialModule) Initialize(settings aria_utility_settings.Setting
 		}
 
 		var entity aria_utility_mqtt.MediaEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
 
-		// 各パーソンの処理を実行
-		for _, person := range persons {
-			if person.Status == 0 && math.Sqrt((float64(person.X)-entity.X/settingMesh)*(float64(person.X)-entity.X/settingMesh)+(float64(person.Y)-entity.Y/settingMesh)*(float64(person.Y)-entity.Y/settingMesh)) < entity.Size/settingMesh && rand.Float64() < entity.Acquisition*person.Data.Acquisition {
+		// 各パーソンの処理を実行（乱数の使用順が変わらないようにID順）
+		ids := make([]int, 0, len(persons))
+		for id := range persons {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			person := persons[id]
+			if person.Status == 0 && math.Sqrt((float64(person.X)-entity.X/settingMesh)*(float64(person.X)-entity.X/settingMesh)+(float64(person.Y)-entity.Y/settingMesh)*(float64(person.Y)-entity.Y/settingMesh)) < entity.Size/settingMesh && randomFloat() < entity.Acquisition*person.Data.Acquisition {
 				person.Status = 2
 			}
 		}
 	}
 
+	// 避難場所の収容人数を受信（ステップの完了時にUniverseが全てのモジュールの人数を集計する）
+	var sheltersRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.SheltersEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+
+		shelters = make(map[string]int)
+		for _, shelter := range entity.Shelters {
+			if shelter.Map != "" {
+				shelters[shelter.Map] = shelter.Occupancy
+			}
+		}
+	}
+
+	// チェックポイント（次のステップの開始前の状態を保存）
+	var checkpointRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CheckpointEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+
+		// 最初のサイクルが始まるまで（サイクルの途中で参加した場合）は何もしない
+		if persons == nil {
+			return
+		}
+		err := aria_utility_mqtt.SaveCheckpoint(entity.Path, moduleID, PotentialCheckpoint{
+			Persons:     persons,
+			RandomSeed:  randomSeed,
+			RandomDraws: randomDraws,
+			Shelters:    shelters,
+		})
+		if err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.CheckpointedEntity{
+			ID:   moduleID,
+			Step: entity.Step,
+		})
+		if token := client.Publish(topics.Checkpointed(), 0, false, bytes); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+	}
+
+	// チェックポイントからの再開（サイクルの開始の代わりに状態を読み込む）
+	var restoreRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CheckpointEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+
+		var state PotentialCheckpoint
+		if err := aria_utility_mqtt.LoadCheckpoint(entity.Path, moduleID, &state); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, err)
+			return
+		}
+
+		// 保存した時と同じIDの範囲が割り当てられていなければ再開できない
+		isSameRange := len(state.Persons) == personIDTo-personIDFrom
+		for i := personIDFrom; i < personIDTo && isSameRange; i++ {
+			_, isSameRange = state.Persons[i]
+		}
+		if !isSameRange {
+			aria_utility_mqtt.ReportError(client, topics, moduleID, msg, fmt.Errorf("checkpoint of %s does not match persons %d to %d", moduleID, personIDFrom, personIDTo))
+			return
+		}
+
+		persons = state.Persons
+		shelters = state.Shelters
+		if shelters == nil {
+			shelters = make(map[string]int)
+		}
+		lastCount = -1
+
+		// 保存した時点まで乱数を進める
+		randomSeed = state.RandomSeed
+		randomDraws = 0
+		random = rand.New(rand.NewSource(randomSeed))
+		for randomDraws < state.RandomDraws {
+			randomFloat()
+		}
+		fmt.Printf("[Potential] Restored : %s (Cycle %d Step %d)\n", moduleID, entity.Cycle, entity.Step)
+
+		// 準備完了をPublish
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.PreparedEntity{
+			ID: moduleID,
+		})
+		if token := client.Publish(topics.Prepared(), 0, false, bytes); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+	}
+
 	// MQTTクライアントの設定
 	opts := MQTT.NewClientOptions().AddBroker(settings.BrokerAddress).SetClientID(xid.New().String())
 	opts.OnConnect = func(client MQTT.Client) {
 
-		// モジュールIDをランダムに設定
-		moduleID = xid.New().String()
-
 		// MQTTのサブスクライブ
-		if token := client.Subscribe(fmt.Sprintf("aria/registered/%s/%s", universeID, moduleID), 0, registeredRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Registered(moduleID), 0, registeredRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Cycle(), 0, cycleRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe(fmt.Sprintf("aria/cycle/%s", universeID), 0, cycleRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Count(), 0, countRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe("/flood/count", 0, countRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Media(), 0, mediaAleatRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe(fmt.Sprintf("aria/media/%s", universeID), 0, mediaAleatRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Shelters(), 0, sheltersRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Checkpoint(), 0, checkpointRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Restore(), 0, restoreRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 
 		// Universeモジュールに参加をPublish
-		bytes, _ := json.Marshal(aria_utility_mqtt.AttendEntity{
-			ID:    moduleID,
-			Count: len(personDatas),
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.AttendEntity{
+			ID:        moduleID,
+			Count:     len(personDatas),
+			Active:    persons != nil,
+			Session:   opts.ClientID,
+			Encodings: aria_utility_mqtt.Encodings,
 		})
-		if token := client.Publish(fmt.Sprintf("aria/attend/%s", universeID), 0, false, bytes); token.Wait() && token.Error() != nil {
+		if token := client.Publish(topics.Attend(), 0, false, bytes); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 
 		fmt.Printf("[Potential] Initialized (%s)\n", opts.ClientID)
 	}
 
+	// 異常切断した場合は、ブローカーから離脱を通知してもらう
+	aria_utility_mqtt.SetLeaveWill(opts, topics, moduleID)
+
 	// MQTTブローカーに接続
-	module.client = MQTT.NewClient(opts)
+	module.client = aria_utility_mqtt.NewClient(settings.Transport, opts)
 	if token := module.client.Connect(); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
 
+	// 生存通知の開始
+	module.presence = aria_utility_mqtt.StartPresence(module.client, topics, moduleID, settings.HeartbeatInterval)
+
 	return &syncer
 }
 
 func (module *PotentialModule) Uninitialize() {
+	module.presence.Leave()
 	module.client.Disconnect(250)
 	fmt.Println("[Potential] Uninitialize")
 }
@@ -589,3 +849,44 @@ func sqrt(value float32) float32 {
 func abs(value float32) float32 {
 	return float32(math.Abs(float64(value)))
 }
+
+// パーソン設定ファイルの読込
+func loadPersonDatas(fileName string, settingMesh float64) []PersonData {
+	personDatas := []PersonData{}
+
+	// ファイルを開く
+	file, _ := os.Open(fileName)
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	// 設定ファイルの内容を解析する
+	reader.Read()
+	for {
+		line, e := reader.Read()
+		if e == io.EOF {
+			break
+		}
+
+		x, _ := strconv.Atoi(line[0])
+		y, _ := strconv.Atoi(line[1])
+		prepareTime, _ := strconv.Atoi(line[3])
+		speed, _ := strconv.ParseFloat(line[4], 64)
+		acquisition := 1.0
+		if len(line) > 14 {
+			acquisition, _ = strconv.ParseFloat(line[14], 64)
+		}
+
+		// パーソンの生成
+		personData := PersonData{
+			X:           int(float64(x) / settingMesh),
+			Y:           int(float64(y) / settingMesh),
+			PrepareTime: prepareTime,
+			Speed:       float32(speed / settingMesh),
+			Alpha:       1.0 / 128.0,
+			Acquisition: acquisition,
+		}
+		personDatas = append(personDatas, personData)
+	}
+	return personDatas
+}
@@ -0,0 +1,122 @@
+package aria_module_recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"aria_utility_mqtt"
+	"aria_utility_settings"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/xid"
+)
+
+// RecorderModule Universeの全てのトピックのメッセージを記録する
+type RecorderModule struct {
+	client MQTT.Client
+	file   *os.File
+	mutex  sync.Mutex
+}
+
+func (recorder *RecorderModule) Initialize(settings aria_utility_settings.SettingEntity) *sync.WaitGroup {
+	syncer := sync.WaitGroup{}
+	syncer.Add(1)
+
+	topics := aria_utility_mqtt.NewTopics(settings.UniverseID, settings.LegacyTopics)
+
+	// 記録ファイル（1行に1メッセージ）
+	file, err := os.Create(settings.RecordFilePath)
+	if err != nil {
+		panic(err)
+	}
+	recorder.file = file
+
+	start := time.Now()
+	cycle := -1 // 現在のサイクル
+	step := -1  // 現在のステップ
+
+	// メッセージの記録
+	recorded := func(kind string) MQTT.MessageHandler {
+		return func(client MQTT.Client, msg MQTT.Message) {
+			recorder.mutex.Lock()
+			defer recorder.mutex.Unlock()
+
+			switch kind {
+			case aria_utility_mqtt.RecordCycle:
+				// 準備フェーズの再実行では、同じサイクルのまま
+				if cycle < 0 || step >= 0 {
+					cycle++
+				}
+				step = -1
+			case aria_utility_mqtt.RecordRestore:
+				// チェックポイントから再開した場合は、保存したステップの開始前から
+				var entity aria_utility_mqtt.CheckpointEntity
+				if aria_utility_mqtt.Decode(msg.Payload(), &entity) == nil {
+					cycle = entity.Cycle
+					step = entity.Step - 1
+				}
+			case aria_utility_mqtt.RecordCount:
+				var entity aria_utility_mqtt.CountEntity
+				if aria_utility_mqtt.Decode(msg.Payload(), &entity) == nil && entity.Count >= 0 {
+					step = entity.Count
+				}
+			}
+
+			now := time.Now()
+			record := aria_utility_mqtt.RecordEntity{
+				Cycle:   cycle,
+				Step:    step,
+				Time:    now.Format(time.RFC3339Nano),
+				Elapsed: now.Sub(start).Milliseconds(),
+				Kind:    kind,
+				Topic:   msg.Topic(),
+			}
+			if json.Valid(msg.Payload()) {
+				record.Payload = msg.Payload()
+			} else {
+				record.Binary = msg.Payload()
+			}
+			bytes, _ := json.Marshal(record)
+			recorder.file.Write(append(bytes, '\n'))
+		}
+	}
+
+	// MQTTクライアントの設定
+	opts := MQTT.NewClientOptions().AddBroker(settings.BrokerAddress).SetClientID(xid.New().String())
+	opts.OnConnect = func(client MQTT.Client) {
+		recordTopics := topics.RecordTopics()
+		kinds := []string{}
+		for kind := range recordTopics {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			if token := client.Subscribe(recordTopics[kind], 0, recorded(kind)); token.Wait() && token.Error() != nil {
+				panic(token.Error())
+			}
+		}
+		fmt.Printf("[Recorder] Initialized (%s) -> %s\n", opts.ClientID, settings.RecordFilePath)
+		syncer.Done()
+	}
+
+	// MQTTブローカーに接続
+	recorder.client = aria_utility_mqtt.NewClient(settings.Transport, opts)
+	if token := recorder.client.Connect(); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+
+	return &syncer
+}
+
+func (recorder *RecorderModule) Uninitialize() {
+	recorder.client.Disconnect(250)
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.file.Close()
+	fmt.Println("[Recorder] Uninitialize")
+}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"aria_utility_floods"
 	"aria_utility_mqtt"
@@ -27,10 +28,20 @@ type Position struct {
 	Y float64
 }
 
+// チェックポイントに保存するRoutingモジュールの状態
+type RoutingCheckpoint struct {
+	QRFloods map[string]Position
+	Events   aria_utility_nodes.MapEvents
+	Shelters map[int]int
+}
+
 func (routing *RoutingModule) Initialize(settings aria_utility_settings.SettingEntity, nodeEntity aria_utility_settings.SettingNodeEntity) *sync.WaitGroup {
 	syncer := sync.WaitGroup{}
 	syncer.Add(1)
 
+	topics := aria_utility_mqtt.NewTopics(settings.UniverseID, settings.LegacyTopics)
+	clientID := xid.New().String()
+
 	// マップファイルの読み込み
 	nodes := aria_utility_nodes.LoadMap(settings, nodeEntity)
 	mapWidth := settings.MapWidth
@@ -41,90 +52,273 @@ func (routing *RoutingModule) Initialize(settings aria_utility_settings.SettingE
 	// QR洪水情報の配列
 	var qrFloods map[string]Position = make(map[string]Position)
 
+	// 避難場所毎の収容人数（前ステップの完了時にUniverseが集計したもの、満員の避難場所には経路を返さない）
+	shelters := make(map[int]int)
+
+	// 交換フェーズで受信したパーソンの位置（ステップ毎、モジュール毎、混雑のコストに使う）
+	intraBuffer := make(map[int]map[string]aria_utility_mqtt.IntraEntity)
+	congestion := make(map[int]int) // 現在のステップの各ノードのパーソンの数
+
+	// 経路計算のプロファイル
+	profiles := newProfiles(settings.Routing)
+
+	// ステップの開始時に作る経路計算の状態（経路要求は作り終えた最新の状態を読む）と地図の版（リンクと避難場所が変わった場合に上げる）
+	version := 0
+	var current atomic.Value
+	current.Store(newSnapshot(nil, version, nodes, shelters, congestion, profiles))
+
+	// 読み込み済みの洪水の予測（洪水ファイルのパス：水深、現在のステップで使わなくなったものは捨てる）
+	forecasts := make(map[string][][]float64)
+
+	// シナリオ（サイクル毎の地図と洪水の変更）
+	var scenario aria_utility_settings.ScenarioEntity
+	if settings.ScenarioFilePath != "" {
+		var err error
+		if scenario, err = aria_utility_settings.LoadScenario(settings); err != nil {
+			panic(err)
+		}
+	}
+	cycleSettings := settings                // 現在のサイクルの設定
+	events := aria_utility_nodes.MapEvents{} // サイクル中の地図の変更（サイクルの開始時に戻す）
+	applyCycle := func(cycleCount int) {
+		isChanged := len(events.Applied) > 0
+		version++
+		events = aria_utility_nodes.MapEvents{}
+		shelters = make(map[int]int)
+		if settings.ScenarioFilePath == "" {
+			if isChanged {
+				nodes = aria_utility_nodes.LoadMap(settings, nodeEntity)
+			}
+			return
+		}
+		cycle := scenario.Cycle(cycleCount)
+		cycleSettings = cycle.Apply(settings)
+		nodes = aria_utility_nodes.LoadScenarioMap(settings, nodeEntity, cycle)
+	}
+
+	// サイクルの開始（シナリオの地図に切り替える）
+	var cycleRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CycleEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
+		applyCycle(entity.Cycle)
+	}
+
 	// ステップの開始
 	var countRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.CountEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
+
+		// 地図の変更の反映
+		applied := len(events.Applied)
+		events.Apply(nodes, entity.Count)
+		if len(events.Applied) != applied {
+			version++
+		}
 
 		// 洪水情報の処理
-		floods, _, _ := aria_utility_floods.LoadFloods(settings, floodWidth, floodHeight, entity.Count)
+		floods, _, _ := aria_utility_floods.LoadFloods(cycleSettings, floodWidth, floodHeight, entity.Count)
 
-		// QR洪水の追加
+		// QR洪水の追加（洪水の予測でも浸水とする）
+		qrCells := make(map[[2]int]bool)
 		for _, qrFlood := range qrFloods {
 			px := int(qrFlood.X / settings.FloodMeshSize)
 			py := int(qrFlood.Y / settings.FloodMeshSize)
 			if px >= 0 && px < floodWidth && py >= 0 && py < floodHeight {
 				floods[px][py] = 1.0
+				qrCells[[2]int{px, py}] = true
 			}
 		}
 
 		for _, node := range nodes {
-			node.From = -1
 			node.Flood = floods[int(node.X/settings.FloodMeshSize)][int(node.Y/settings.FloodMeshSize)]
 		}
 
-		// 簡易経路計算
-		tasks := []*aria_utility_nodes.NodeEntity{}
-		for _, node := range nodes {
-			if node.IsShelter {
-				node.From = node.NID
-				tasks = append(tasks, node)
+		// 洪水の予測（先のステップの洪水ファイル、ファイルがないステップ以降は予測しない）
+		slices := [][][]float64{}
+		cached := make(map[string][][]float64)
+		for step := entity.Count + 1; step <= entity.Count+settings.Routing.ForecastSteps; step++ {
+			path := fmt.Sprintf(cycleSettings.FloodFilePath, step)
+			slice, exists := forecasts[path]
+			if !exists {
+				if !aria_utility_floods.HasFloods(cycleSettings, step) {
+					break
+				}
+				slice, _, _ = aria_utility_floods.LoadFloods(cycleSettings, floodWidth, floodHeight, step)
 			}
+			cached[path] = slice
+			slices = append(slices, slice)
 		}
-		taskIndex := 0
-		for {
-			if taskIndex == len(tasks) {
-				break
+		forecasts = cached
+		for _, node := range nodes {
+			px := int(node.X / settings.FloodMeshSize)
+			py := int(node.Y / settings.FloodMeshSize)
+			node.Forecast = node.Forecast[:0]
+			for _, slice := range slices {
+				if qrCells[[2]int{px, py}] {
+					node.Forecast = append(node.Forecast, 1.0)
+				} else {
+					node.Forecast = append(node.Forecast, slice[px][py])
+				}
 			}
-			node := tasks[taskIndex]
-			taskIndex++
+		}
 
-			if node.Flood > 0.5 {
-				continue
+		// 混雑（前ステップの各ノードのパーソンの数、避難場所にいるパーソンは避難済みなので数えない）
+		congestion = make(map[int]int)
+		for _, intra := range intraBuffer[entity.Count] {
+			for _, person := range intra.Persons {
+				if node, exists := nodes[person.NID]; exists && !node.IsShelter {
+					congestion[person.NID]++
+				}
+			}
+		}
+		for count := range intraBuffer {
+			if count <= entity.Count {
+				delete(intraBuffer, count)
 			}
+		}
+
+		// 経路計算（満員の避難場所は通過のみ、前のステップで要求されたプロファイルの経路の木を作ってから入れ替える）
+		current.Store(newSnapshot(current.Load().(*routeSnapshot), version, nodes, shelters, congestion, profiles))
+
+		// fmt.Printf("--- Route Updated %d ---\n", entity.Count)
+	}
+
+	// 要求に対する経路（目的地、目的地に到達できない場合や浸水している場合は受け入れ可能な最寄りの避難場所まで、見つからない場合はnil）
+	findPath := func(snapshot *routeSnapshot, entity aria_utility_mqtt.RouteEntity) []int {
+		profile := profiles[entity.Profile]
+		start := snapshot.nodes[entity.StartNID]
+		var target *aria_utility_nodes.NodeEntity
+		if entity.TargetNID > 0 {
+			target = snapshot.nodes[entity.TargetNID]
+		}
 
-			for _, neighbor := range node.Neighbors {
-				if neighbor.Node.From < 0 {
-					neighbor.Node.From = node.NID
-					tasks = append(tasks, neighbor.Node)
+		// 到着時の予測水深を見る場合は要求毎に探索する
+		if settings.Routing.ForecastSteps > 0 {
+			speed := entity.Speed
+			if speed == 0 {
+				speed = settings.Routing.ForecastSpeed
+			}
+			if target != nil {
+				if path := forecastRoute(start, target, snapshot.shelters, profile, snapshot.congestion, speed); path != nil {
+					return path
 				}
 			}
+			return forecastRoute(start, nil, snapshot.shelters, profile, snapshot.congestion, speed)
 		}
 
-		// fmt.Printf("--- Route Updated %d ---\n", entity.Count)
+		if target != nil {
+			if path := findRoute(start, target, profile, snapshot.congestion, snapshot.scale); path != nil {
+				return path
+			}
+		}
+		return snapshot.tree(entity.Profile).route(start)
 	}
 
-	// ルートリクエストの受信
+	// 経路要求への応答（起点から目的地または避難場所までの経路、見つからない場合や不正な要求の場合は理由とエラー、知らないプロファイルの場合は経路とエラー）
+	answerRoute := func(entity aria_utility_mqtt.RouteEntity) ([]int, aria_utility_mqtt.RouteFailureEntity, error) {
+		snapshot := current.Load().(*routeSnapshot)
+		failure := aria_utility_mqtt.RouteFailureEntity{StartNID: entity.StartNID, TargetNID: entity.TargetNID}
+		if _, exists := snapshot.nodes[entity.StartNID]; !exists {
+			failure.Reason, failure.NID = aria_utility_mqtt.RouteUnknownNode, entity.StartNID
+			return nil, failure, fmt.Errorf("startNID: unknown node %d", entity.StartNID)
+		}
+		if _, exists := snapshot.nodes[entity.TargetNID]; entity.TargetNID > 0 && !exists {
+			failure.Reason, failure.NID = aria_utility_mqtt.RouteUnknownNode, entity.TargetNID
+			return nil, failure, fmt.Errorf("targetNID: unknown node %d", entity.TargetNID)
+		}
+
+		// 知らないプロファイルは報告して、設定ファイルのコストで探索する
+		var err error
+		if _, exists := profiles[entity.Profile]; !exists {
+			err = fmt.Errorf("profile: unknown routing profile %q", entity.Profile)
+			entity.Profile = aria_utility_mqtt.RouteProfileDefault
+		}
+
+		path := findPath(snapshot, entity)
+		if path == nil {
+			// 避難場所に到達できない場合
+			failure.Reason = aria_utility_mqtt.RouteUnreachable
+			if snapshot.nodes[entity.StartNID].Flood > floodLimit(settings.Routing) {
+				failure.Reason = aria_utility_mqtt.RouteStartFlooded
+			}
+		}
+		return path, failure, err
+	}
+
+	// ルートリクエストの受信（外部のクライアント向け、パーソン毎）
 	var routeRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		id := strings.Split(msg.Topic(), "/")[len(strings.Split(msg.Topic(), "/"))-1]
+		route := []string{}
+
+		// 経路が見つからない場合や不正な要求の場合も、理由を返す（Personモジュールは全ての応答を待ってから次のステップに進む）
 		var entity aria_utility_mqtt.RouteEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		var path []int
+		failure := aria_utility_mqtt.RouteFailureEntity{Reason: aria_utility_mqtt.RouteInvalidRequest}
+		err := aria_utility_mqtt.Decode(msg.Payload(), &entity)
+		if err == nil {
+			path, failure, err = answerRoute(entity)
+		}
+		if err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+		}
+		for _, nid := range path {
+			route = append(route, strconv.Itoa(nid))
+		}
 
+		bytes, _ := json.Marshal(route)
+		if path == nil {
+			bytes = aria_utility_mqtt.Encode(&failure)
+		}
+		token := client.Publish(topics.RouteResponse(id), 0, false, bytes)
+		token.Wait()
+	}
+
+	// まとめたルートリクエストの受信（Personモジュール毎、要求と同じ順に応答する）
+	var routeBatchRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		id := strings.Split(msg.Topic(), "/")[len(strings.Split(msg.Topic(), "/"))-1]
 
-		route := []string{}
-		routeNode := nodes[entity.StartNID]
-		for {
-			route = append(route, strconv.Itoa(routeNode.NID))
-			if routeNode.IsShelter || routeNode.From == -1 {
-				break
-			}
-			routeNode = nodes[routeNode.From]
+		// 解釈できない場合も空の応答を返す（ステップがわからないので、Personモジュールは現在のステップの応答として扱わない）
+		var entity aria_utility_mqtt.RouteBatchEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			entity = aria_utility_mqtt.RouteBatchEntity{}
 		}
 
-		if routeNode.IsShelter {
-			bytes, _ := json.Marshal(route)
-			token := client.Publish(fmt.Sprintf("/person/recv/start2target/%s", id), 0, false, bytes)
-			token.Wait()
-
-			// fmt.Printf("Routed %s (%d -> %d)\n", id, entity.StartNID, routeNode.NID)
-		} else {
-			// fmt.Printf("Routed %s (%d -> x)\n", id, entity.StartNID)
+		results := aria_utility_mqtt.RouteBatchResultEntity{Count: entity.Count, Routes: []aria_utility_mqtt.RouteResultEntity{}}
+		for no, request := range entity.Requests {
+			path, failure, err := answerRoute(aria_utility_mqtt.RouteEntity{
+				StartNID:  request.StartNID,
+				TargetNID: request.TargetNID,
+				Speed:     request.Speed,
+				Profile:   request.Profile,
+			})
+			if err != nil {
+				aria_utility_mqtt.ReportError(client, topics, clientID, msg, fmt.Errorf("requests[%d].%v", no, err))
+			}
+			result := aria_utility_mqtt.RouteResultEntity{ID: request.ID, Route: path}
+			if path == nil {
+				result.Route = []int{}
+				result.Reason, result.NID = failure.Reason, failure.NID
+			}
+			results.Routes = append(results.Routes, result)
+		}
+		if token := client.Publish(topics.RouteBatchResponse(id), 0, false, aria_utility_mqtt.Encode(&results)); token.Wait() && token.Error() != nil {
+			panic(token.Error())
 		}
 	}
 
 	var qrFloodRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.CameraEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
 
 		if qrFlood, exists := qrFloods[entity.Data]; exists {
 			qrFlood.X = float64(entity.X-entity.Left) * mapWidth / float64(entity.Right-entity.Left)
@@ -137,16 +331,124 @@ func (routing *RoutingModule) Initialize(settings aria_utility_settings.SettingE
 		}
 	}
 
+	// 交換フェーズのパーソンの位置を受信（ステップの開始時に混雑として数える、再実行で重複しないようにモジュール毎に保持する）
+	var intraRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		entity, err := aria_utility_mqtt.DecodeIntra(msg.Payload())
+		if err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
+
+		if _, exists := intraBuffer[entity.Count]; !exists {
+			intraBuffer[entity.Count] = make(map[string]aria_utility_mqtt.IntraEntity)
+		}
+		intraBuffer[entity.Count][entity.ID] = entity
+	}
+
+	// 地図の変更の受信（ステップの開始時に反映する）
+	var eventRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.EventEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
+		event := aria_utility_nodes.MapEvent{Step: entity.Step, Type: entity.Type, Target: entity.Target}
+		if err := aria_utility_nodes.ValidateEvent(nodes, event); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
+		events.Add(event)
+	}
+
+	// 避難場所の収容人数を受信（次のステップの経路計算に使う）
+	var sheltersRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.SheltersEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
+
+		shelters = make(map[int]int)
+		for _, shelter := range entity.Shelters {
+			if shelter.Map == "" {
+				shelters[shelter.NID] = shelter.Occupancy
+			}
+		}
+	}
+
+	// チェックポイント（経路計算はステップ毎にやり直すので、QR洪水情報、地図の変更、避難場所の収容人数のみ保存する）
+	var checkpointRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CheckpointEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
+
+		if err := aria_utility_mqtt.SaveCheckpoint(entity.Path, aria_utility_mqtt.CheckpointRouting, RoutingCheckpoint{QRFloods: qrFloods, Events: events, Shelters: shelters}); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+		}
+	}
+
+	// チェックポイントからの再開
+	var restoreRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CheckpointEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
+
+		var state RoutingCheckpoint
+		if err := aria_utility_mqtt.LoadCheckpoint(entity.Path, aria_utility_mqtt.CheckpointRouting, &state); err != nil {
+			aria_utility_mqtt.ReportError(client, topics, clientID, msg, err)
+			return
+		}
+		applyCycle(entity.Cycle)
+		qrFloods = state.QRFloods
+		if qrFloods == nil {
+			qrFloods = make(map[string]Position)
+		}
+		events = state.Events
+		events.Reapply(nodes)
+		version++
+		shelters = state.Shelters
+		if shelters == nil {
+			shelters = make(map[int]int)
+		}
+	}
+
 	// MQTTクライアントの設定
-	opts := MQTT.NewClientOptions().AddBroker(settings.BrokerAddress).SetClientID(xid.New().String())
+	opts := MQTT.NewClientOptions().AddBroker(settings.BrokerAddress).SetClientID(clientID)
 	opts.OnConnect = func(client MQTT.Client) {
-		if token := client.Subscribe("/person/send/start2target/+", 0, routeRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.RouteRequest("+"), 0, routeRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.RouteBatchRequest("+"), 0, routeBatchRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Count(), 0, countRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Cycle(), 0, cycleRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.CameraFlood("+"), 0, qrFloodRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe("/flood/count", 0, countRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Event(), 0, eventRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(topics.Shelters(), 0, sheltersRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if settings.Routing.CongestionWeight != 0 {
+			if token := client.Subscribe(topics.Intra(), 0, intraRecieved); token.Wait() && token.Error() != nil {
+				panic(token.Error())
+			}
+		}
+		if token := client.Subscribe(topics.Checkpoint(), 0, checkpointRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe("/camera/flood/+", 0, qrFloodRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(topics.Restore(), 0, restoreRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 		fmt.Printf("[Routing ] Initialized (%s)\n", opts.ClientID)
@@ -154,7 +456,7 @@ func (routing *RoutingModule) Initialize(settings aria_utility_settings.SettingE
 	}
 
 	// MQTTブローカーに接続
-	routing.client = MQTT.NewClient(opts)
+	routing.client = aria_utility_mqtt.NewClient(settings.Transport, opts)
 	if token := routing.client.Connect(); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
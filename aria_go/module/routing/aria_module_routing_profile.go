@@ -0,0 +1,78 @@
+package aria_module_routing
+
+import (
+	"aria_utility_mqtt"
+	"aria_utility_nodes"
+	"aria_utility_settings"
+)
+
+// 設定ファイルの値が0の場合のプロファイルの値
+const (
+	defaultSafestFloodWeight = 10.0 // safestのFloodWeight
+	defaultMainRoadWidth     = 6.0  // main_roadsで主要道路とするリンクの幅
+	defaultMinorRoadWeight   = 1.0  // main_roadsで主要道路以外のリンクの長さに加える割合
+)
+
+// routingProfile 経路計算のプロファイル（パーソンファイルで選ぶ、プロファイル毎に避難場所に向かう経路の木を作る）
+type routingProfile struct {
+	Costs           aria_utility_settings.SettingRoutingEntity // リンクのコスト
+	DesignatedOnly  bool                                       // 指定避難場所にのみ向かう
+	MainRoadWidth   float64                                    // この幅以上のリンクを主要道路とする
+	MinorRoadWeight float64                                    // 主要道路以外のリンクの長さに加える割合（0：区別しない）
+}
+
+// newProfiles 設定ファイルのRoutingから全てのプロファイルを作る
+func newProfiles(costs aria_utility_settings.SettingRoutingEntity) map[string]routingProfile {
+	shortest := costs
+	shortest.FloodWeight = 0
+	shortest.SlopeWeight = 0
+	shortest.CongestionWeight = 0
+
+	safest := costs
+	safest.FloodWeight = costs.SafestFloodWeight
+	if safest.FloodWeight == 0 {
+		safest.FloodWeight = defaultSafestFloodWeight
+	}
+
+	mainRoads := routingProfile{Costs: costs, MainRoadWidth: costs.MainRoadWidth, MinorRoadWeight: costs.MinorRoadWeight}
+	if mainRoads.MainRoadWidth == 0 {
+		mainRoads.MainRoadWidth = defaultMainRoadWidth
+	}
+	if mainRoads.MinorRoadWeight == 0 {
+		mainRoads.MinorRoadWeight = defaultMinorRoadWeight
+	}
+
+	return map[string]routingProfile{
+		aria_utility_mqtt.RouteProfileDefault:    {Costs: costs},
+		aria_utility_mqtt.RouteProfileShortest:   {Costs: shortest},
+		aria_utility_mqtt.RouteProfileSafest:     {Costs: safest},
+		aria_utility_mqtt.RouteProfileDesignated: {Costs: costs, DesignatedOnly: true},
+		aria_utility_mqtt.RouteProfileMainRoads:  mainRoads,
+	}
+}
+
+// accepts ノードがこのプロファイルで向かう避難場所として受け入れ可能か
+func (profile routingProfile) accepts(node *aria_utility_nodes.NodeEntity, shelters map[int]int) bool {
+	return node.IsOpen(shelters) && (!profile.DesignatedOnly || node.IsDesignated)
+}
+
+// linkCost fromからtoに進むリンクのコスト
+func (profile routingProfile) linkCost(from *aria_utility_nodes.NodeEntity, to *aria_utility_nodes.NodeEntity, link aria_utility_nodes.NeighborEntity, persons map[int]int) float64 {
+	length := link.Length
+	if profile.MinorRoadWeight != 0 && link.Width < profile.MainRoadWidth {
+		length *= 1 + profile.MinorRoadWeight
+	}
+
+	costs := profile.Costs
+	cost := length * (1 + costs.FloodWeight*to.Flood + costs.CongestionWeight*float64(persons[to.NID]))
+	if rise := (to.Height - from.Height) / 100.0; rise > 0 {
+		cost += costs.SlopeWeight * rise
+	}
+	return cost
+}
+
+// isAdmissible A*の推定コスト（直線距離×リンクの長さの比）が実際のコストを超えないか（負のコストがない）
+func (profile routingProfile) isAdmissible() bool {
+	costs := profile.Costs
+	return costs.FloodWeight >= 0 && costs.SlopeWeight >= 0 && costs.CongestionWeight >= 0 && profile.MinorRoadWeight >= 0
+}
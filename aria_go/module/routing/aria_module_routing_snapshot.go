@@ -0,0 +1,125 @@
+package aria_module_routing
+
+import (
+	"sync"
+
+	"aria_utility_nodes"
+)
+
+// 水深や混雑が変わったノードがこの割合以下の場合は、前のステップの経路の木を部分的に探索し直す
+const incrementalRatio = 0.1
+
+// routeSnapshot ステップの開始時の経路計算の状態（作成後は変更しない、経路要求は最新の状態を使う）
+type routeSnapshot struct {
+	version    int                                    // 地図（リンクと避難場所）の版
+	nodes      map[int]*aria_utility_nodes.NodeEntity // ノードのコピー（水深と予測水深を含む）
+	shelters   map[int]int                            // 避難場所毎の収容人数
+	congestion map[int]int                            // 各ノードのパーソンの数
+	scale      float64                                // 目的地への経路探索（A*）の推定コストの係数
+	profiles   map[string]routingProfile
+
+	mutex sync.Mutex            // treesの保護（作成時にないプロファイルは最初の要求の時に作る）
+	trees map[string]*routeTree // 各プロファイルの避難場所に向かう経路の木
+}
+
+// newSnapshot 現在の地図と避難場所と混雑から状態を作る
+// 前の状態（previous）で使っていたプロファイルの経路の木は並列に作り、地図が同じで変わったノードが少ない場合は部分的に探索し直す
+func newSnapshot(previous *routeSnapshot, version int, nodes map[int]*aria_utility_nodes.NodeEntity, shelters map[int]int, congestion map[int]int, profiles map[string]routingProfile) *routeSnapshot {
+	snapshot := &routeSnapshot{
+		version:    version,
+		nodes:      copyNodes(nodes),
+		shelters:   make(map[int]int, len(shelters)),
+		congestion: make(map[int]int, len(congestion)),
+		profiles:   profiles,
+		trees:      make(map[string]*routeTree),
+	}
+	for nid, occupancy := range shelters {
+		snapshot.shelters[nid] = occupancy
+	}
+	for nid, count := range congestion {
+		snapshot.congestion[nid] = count
+	}
+	snapshot.scale = heuristicScale(snapshot.nodes)
+	if previous == nil {
+		return snapshot
+	}
+
+	previous.mutex.Lock()
+	olds := make(map[string]*routeTree, len(previous.trees))
+	for name, tree := range previous.trees {
+		olds[name] = tree
+	}
+	previous.mutex.Unlock()
+
+	wait := sync.WaitGroup{}
+	for name, old := range olds {
+		wait.Add(1)
+		go func(name string, old *routeTree) {
+			defer wait.Done()
+			tree := snapshot.nextTree(previous, old, profiles[name])
+			snapshot.mutex.Lock()
+			snapshot.trees[name] = tree
+			snapshot.mutex.Unlock()
+		}(name, old)
+	}
+	wait.Wait()
+	return snapshot
+}
+
+// nextTree 前の状態の経路の木（old）から、この状態のプロファイルの経路の木を作る
+// 地図や受け入れ可能な避難場所が変わった場合、変わったノードが多い場合は作り直す
+func (snapshot *routeSnapshot) nextTree(previous *routeSnapshot, old *routeTree, profile routingProfile) *routeTree {
+	if previous.version != snapshot.version {
+		return buildTree(snapshot.nodes, snapshot.shelters, profile, snapshot.congestion)
+	}
+
+	changed := []int{}
+	for nid, node := range snapshot.nodes {
+		before, exists := previous.nodes[nid]
+		if !exists || profile.accepts(node, snapshot.shelters) != profile.accepts(before, previous.shelters) {
+			return buildTree(snapshot.nodes, snapshot.shelters, profile, snapshot.congestion)
+		}
+		if node.Flood != before.Flood || (profile.Costs.CongestionWeight != 0 && snapshot.congestion[nid] != previous.congestion[nid]) {
+			changed = append(changed, nid)
+		}
+	}
+	if len(changed) == 0 {
+		return old
+	}
+	if float64(len(changed)) > incrementalRatio*float64(len(snapshot.nodes)) {
+		return buildTree(snapshot.nodes, snapshot.shelters, profile, snapshot.congestion)
+	}
+	return old.update(snapshot.nodes, profile, snapshot.congestion, changed)
+}
+
+// tree プロファイルの経路の木（ない場合は作る）
+func (snapshot *routeSnapshot) tree(name string) *routeTree {
+	snapshot.mutex.Lock()
+	defer snapshot.mutex.Unlock()
+	tree, exists := snapshot.trees[name]
+	if !exists {
+		tree = buildTree(snapshot.nodes, snapshot.shelters, snapshot.profiles[name], snapshot.congestion)
+		snapshot.trees[name] = tree
+	}
+	return tree
+}
+
+// copyNodes ノードとリンクのコピー（近隣のノードはコピーを指す、通行止めのリンクは含めない）
+func copyNodes(nodes map[int]*aria_utility_nodes.NodeEntity) map[int]*aria_utility_nodes.NodeEntity {
+	copies := make(map[int]*aria_utility_nodes.NodeEntity, len(nodes))
+	for nid, node := range nodes {
+		copied := *node
+		copied.Forecast = append([]float64(nil), node.Forecast...)
+		copied.ClosedNeighbors = nil
+		copies[nid] = &copied
+	}
+	for _, node := range copies {
+		neighbors := make([]aria_utility_nodes.NeighborEntity, len(node.Neighbors))
+		for i, neighbor := range node.Neighbors {
+			neighbor.Node = copies[neighbor.Node.NID]
+			neighbors[i] = neighbor
+		}
+		node.Neighbors = neighbors
+	}
+	return copies
+}
@@ -0,0 +1,307 @@
+package aria_module_routing
+
+import (
+	"container/heap"
+	"math"
+
+	"aria_utility_nodes"
+	"aria_utility_settings"
+)
+
+// 設定ファイルのFloodLimitが0の場合の水深（m）
+const defaultFloodLimit = 0.5
+
+// 探索中のノード
+type treeItem struct {
+	node *aria_utility_nodes.NodeEntity
+	cost float64
+}
+
+// 探索待ちのノード（コストが同じ場合はNIDが小さい順に取り出す）
+type treeQueue []treeItem
+
+func (queue treeQueue) Len() int { return len(queue) }
+
+func (queue treeQueue) Less(i, j int) bool {
+	if queue[i].cost != queue[j].cost {
+		return queue[i].cost < queue[j].cost
+	}
+	return queue[i].node.NID < queue[j].node.NID
+}
+
+func (queue treeQueue) Swap(i, j int) { queue[i], queue[j] = queue[j], queue[i] }
+
+func (queue *treeQueue) Push(item interface{}) { *queue = append(*queue, item.(treeItem)) }
+
+func (queue *treeQueue) Pop() interface{} {
+	old := *queue
+	item := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return item
+}
+
+// 通れない水深（m）
+func floodLimit(costs aria_utility_settings.SettingRoutingEntity) float64 {
+	if costs.FloodLimit == 0 {
+		return defaultFloodLimit
+	}
+	return costs.FloodLimit
+}
+
+// routeTree 受け入れ可能な避難場所に向かう経路の木（作成後は変更しない）
+type routeTree struct {
+	next  map[int]int     // 避難場所に向かう次のノード（避難場所は自身、到達できないノードはない）
+	costs map[int]float64 // 避難場所までのコスト
+}
+
+// buildTree 受け入れ可能な全ての避難場所から逆向きに探索し（ダイクストラ法）、各ノードから避難場所に向かう次のノードを決める
+// 浸水したノードには到達できるが、そこから先には進まない
+func buildTree(nodes map[int]*aria_utility_nodes.NodeEntity, shelters map[int]int, profile routingProfile, persons map[int]int) *routeTree {
+	tree := &routeTree{next: map[int]int{}, costs: map[int]float64{}}
+	queue := &treeQueue{}
+	for _, node := range nodes {
+		if profile.accepts(node, shelters) {
+			tree.next[node.NID] = node.NID
+			tree.costs[node.NID] = 0
+			heap.Push(queue, treeItem{node: node, cost: 0})
+		}
+	}
+	tree.search(queue, profile, persons)
+	return tree
+}
+
+// update 水深や混雑が変わったノード（changed）を通る部分木だけを探索し直した木（避難場所と地図は同じであること）
+// 同じコストの経路はbuildTreeと同じ規則で選ぶので、作り直した場合と同じ木になる
+func (tree *routeTree) update(nodes map[int]*aria_utility_nodes.NodeEntity, profile routingProfile, persons map[int]int, changed []int) *routeTree {
+	updated := &routeTree{next: make(map[int]int, len(tree.next)), costs: make(map[int]float64, len(tree.costs))}
+	children := map[int][]int{}
+	for nid, next := range tree.next {
+		updated.next[nid] = next
+		updated.costs[nid] = tree.costs[nid]
+		if next != nid {
+			children[next] = append(children[next], nid)
+		}
+	}
+
+	// 変わったノードを通って避難場所に向かっていたノード（避難場所は残す）
+	affected := map[int]bool{}
+	for len(changed) > 0 {
+		nid := changed[len(changed)-1]
+		changed = changed[:len(changed)-1]
+		if affected[nid] {
+			continue
+		}
+		affected[nid] = true
+		changed = append(changed, children[nid]...)
+	}
+	queue := &treeQueue{}
+	for nid := range affected {
+		if next, exists := updated.next[nid]; exists && next == nid {
+			heap.Push(queue, treeItem{node: nodes[nid], cost: 0})
+			continue
+		}
+		delete(updated.next, nid)
+		delete(updated.costs, nid)
+	}
+
+	// 影響を受けていない隣のノードから探索し直す
+	limit := floodLimit(profile.Costs)
+	for nid := range affected {
+		node := nodes[nid]
+		if _, exists := updated.next[nid]; exists || node == nil {
+			continue
+		}
+		for _, neighbor := range node.Neighbors {
+			via := neighbor.Node
+			if _, exists := updated.costs[via.NID]; !exists || affected[via.NID] || via.Flood > limit {
+				continue
+			}
+			updated.relax(queue, node, via, updated.costs[via.NID]+profile.linkCost(node, via, neighbor, persons))
+		}
+	}
+	updated.search(queue, profile, persons)
+	return updated
+}
+
+// search queueのノードから順に確定し、隣のノードのコストを更新する
+func (tree *routeTree) search(queue *treeQueue, profile routingProfile, persons map[int]int) {
+	limit := floodLimit(profile.Costs)
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(treeItem)
+		node := item.node
+		if item.cost > tree.costs[node.NID] || node.Flood > limit {
+			continue
+		}
+
+		for _, neighbor := range node.Neighbors {
+			tree.relax(queue, neighbor.Node, node, tree.costs[node.NID]+profile.linkCost(neighbor.Node, node, neighbor, persons))
+		}
+	}
+}
+
+// relax viaを経由する場合のコストでnodeを更新し、コストが下がった場合はqueueに追加する
+// 同じコストの場合は、ダイクストラ法で先に確定する方（コスト、NIDの順に小さい方）を次のノードにする
+func (tree *routeTree) relax(queue *treeQueue, node *aria_utility_nodes.NodeEntity, via *aria_utility_nodes.NodeEntity, cost float64) {
+	if next, exists := tree.next[node.NID]; exists {
+		old := tree.costs[node.NID]
+		if next == node.NID || cost > old {
+			return
+		}
+		if cost == old {
+			if viaCost, nextCost := tree.costs[via.NID], tree.costs[next]; viaCost < nextCost || (viaCost == nextCost && via.NID < next) {
+				tree.next[node.NID] = via.NID
+			}
+			return
+		}
+	}
+	tree.next[node.NID] = via.NID
+	tree.costs[node.NID] = cost
+	heap.Push(queue, treeItem{node: node, cost: cost})
+}
+
+// route startから避難場所までの経路（startと避難場所を含む、到達できない場合はnil）
+func (tree *routeTree) route(start *aria_utility_nodes.NodeEntity) []int {
+	route := []int{}
+	for nid := start.NID; ; {
+		route = append(route, nid)
+		next, exists := tree.next[nid]
+		if !exists {
+			return nil
+		}
+		if next == nid {
+			return route
+		}
+		nid = next
+	}
+}
+
+// heuristicScale A*の推定コストに使う、リンクの長さと両端の直線距離の比の最小値
+func heuristicScale(nodes map[int]*aria_utility_nodes.NodeEntity) float64 {
+	scale := math.Inf(1)
+	for _, node := range nodes {
+		for _, neighbor := range node.Neighbors {
+			if distance := math.Hypot(neighbor.Node.X-node.X, neighbor.Node.Y-node.Y); distance > 0 {
+				scale = math.Min(scale, neighbor.Length/distance)
+			}
+		}
+	}
+	if math.IsInf(scale, 1) {
+		return 0
+	}
+	return scale
+}
+
+// findRoute startからtargetまでのコストが最小の経路（A*、startとtargetを含む、到達できない場合はnil）
+// 浸水したノードは起点以外通らず、浸水した目的地には向かわない
+func findRoute(start *aria_utility_nodes.NodeEntity, target *aria_utility_nodes.NodeEntity, profile routingProfile, persons map[int]int, scale float64) []int {
+	limit := floodLimit(profile.Costs)
+	if target.Flood > limit {
+		return nil
+	}
+	if !profile.isAdmissible() {
+		scale = 0
+	}
+	estimate := func(node *aria_utility_nodes.NodeEntity) float64 {
+		return scale * math.Hypot(target.X-node.X, target.Y-node.Y)
+	}
+
+	spent := map[int]float64{start.NID: 0}
+	froms := map[int]int{}
+	closed := map[int]bool{}
+	queue := &treeQueue{}
+	heap.Push(queue, treeItem{node: start, cost: estimate(start)})
+	for queue.Len() > 0 {
+		node := heap.Pop(queue).(treeItem).node
+		if closed[node.NID] {
+			continue
+		}
+		closed[node.NID] = true
+
+		if node == target {
+			return routeTo(froms, start, target)
+		}
+		if node != start && node.Flood > limit {
+			continue
+		}
+
+		for _, neighbor := range node.Neighbors {
+			cost := spent[node.NID] + profile.linkCost(node, neighbor.Node, neighbor, persons)
+			if old, exists := spent[neighbor.Node.NID]; !exists || cost < old {
+				spent[neighbor.Node.NID] = cost
+				froms[neighbor.Node.NID] = node.NID
+				heap.Push(queue, treeItem{node: neighbor.Node, cost: cost + estimate(neighbor.Node)})
+			}
+		}
+	}
+	return nil
+}
+
+// forecastRoute startから目的地（targetがnilの場合は受け入れ可能な最寄りの避難場所）までのコストが最小の経路（ダイクストラ法、見つからない場合はnil）
+// 歩いた距離とspeedから各ノードに着くステップを求め、その時の予測水深がFloodLimitを超えるノードは通らない
+func forecastRoute(start *aria_utility_nodes.NodeEntity, target *aria_utility_nodes.NodeEntity, shelters map[int]int, profile routingProfile, persons map[int]int, speed float64) []int {
+	limit := floodLimit(profile.Costs)
+	isGoal := func(node *aria_utility_nodes.NodeEntity) bool {
+		if target != nil {
+			return node == target
+		}
+		return profile.accepts(node, shelters)
+	}
+
+	spent := map[int]float64{start.NID: 0}
+	walked := map[int]float64{start.NID: 0}
+	froms := map[int]int{}
+	closed := map[int]bool{}
+	queue := &treeQueue{}
+	heap.Push(queue, treeItem{node: start, cost: 0})
+	for queue.Len() > 0 {
+		node := heap.Pop(queue).(treeItem).node
+		if closed[node.NID] {
+			continue
+		}
+		closed[node.NID] = true
+
+		if isGoal(node) {
+			return routeTo(froms, start, node)
+		}
+
+		for _, neighbor := range node.Neighbors {
+			distance := walked[node.NID] + neighbor.Length
+			if closed[neighbor.Node.NID] || forecastDepth(neighbor.Node, distance, speed) > limit {
+				continue
+			}
+			cost := spent[node.NID] + profile.linkCost(node, neighbor.Node, neighbor, persons)
+			if old, exists := spent[neighbor.Node.NID]; !exists || cost < old {
+				spent[neighbor.Node.NID] = cost
+				walked[neighbor.Node.NID] = distance
+				froms[neighbor.Node.NID] = node.NID
+				heap.Push(queue, treeItem{node: neighbor.Node, cost: cost})
+			}
+		}
+	}
+	return nil
+}
+
+// forecastDepth distanceだけ歩いてノードに着くステップの予測水深（予測がない先のステップは最後の予測）
+func forecastDepth(node *aria_utility_nodes.NodeEntity, distance float64, speed float64) float64 {
+	steps := 0
+	if speed > 0 {
+		steps = int(distance / speed)
+	}
+	if steps == 0 || len(node.Forecast) == 0 {
+		return node.Flood
+	}
+	if steps > len(node.Forecast) {
+		steps = len(node.Forecast)
+	}
+	return node.Forecast[steps-1]
+}
+
+// startからgoalまでの経路（探索で記録した直前のノードを辿る、startとgoalを含む）
+func routeTo(froms map[int]int, start *aria_utility_nodes.NodeEntity, goal *aria_utility_nodes.NodeEntity) []int {
+	route := []int{goal.NID}
+	for nid := goal.NID; nid != start.NID; {
+		nid = froms[nid]
+		route = append([]int{nid}, route...)
+	}
+	return route
+}
@@ -0,0 +1,132 @@
+package aria_module_routing
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"aria_utility_nodes"
+	"aria_utility_settings"
+)
+
+const testGridSize = 15
+
+// testMap 格子状の地図（リンクの長さは同じコストの経路ができるように整数）
+func testMap(random *rand.Rand) map[int]*aria_utility_nodes.NodeEntity {
+	nodes := map[int]*aria_utility_nodes.NodeEntity{}
+	for y := 0; y < testGridSize; y++ {
+		for x := 0; x < testGridSize; x++ {
+			nid := y*testGridSize + x
+			nodes[nid] = &aria_utility_nodes.NodeEntity{NID: nid, X: float64(x) * 10, Y: float64(y) * 10, Height: float64(random.Intn(5))}
+		}
+	}
+	linkID := 0
+	connect := func(from, to *aria_utility_nodes.NodeEntity) {
+		length := float64(10 * (1 + random.Intn(3)))
+		width := float64(2 + random.Intn(2)*6)
+		from.Neighbors = append(from.Neighbors, aria_utility_nodes.NeighborEntity{Node: to, Length: length, LinkID: linkID, Width: width})
+		to.Neighbors = append(to.Neighbors, aria_utility_nodes.NeighborEntity{Node: from, Length: length, LinkID: linkID, Width: width})
+		linkID++
+	}
+	for y := 0; y < testGridSize; y++ {
+		for x := 0; x < testGridSize; x++ {
+			node := nodes[y*testGridSize+x]
+			if x+1 < testGridSize {
+				connect(node, nodes[node.NID+1])
+			}
+			if y+1 < testGridSize {
+				connect(node, nodes[node.NID+testGridSize])
+			}
+		}
+	}
+	for _, nid := range random.Perm(len(nodes))[:6] {
+		nodes[nid].IsShelter = true
+		nodes[nid].IsDesignated = nid%2 == 0
+		nodes[nid].Capacity = random.Intn(3) * 5
+	}
+	return nodes
+}
+
+// changeFloods 一部のノードの水深と混雑を変え、変えたノードを返す
+func changeFloods(random *rand.Rand, nodes map[int]*aria_utility_nodes.NodeEntity, persons map[int]int, count int) []int {
+	floods := []float64{0, 0, 0.2, 0.4, 0.6, 1.0}
+	changed := []int{}
+	for _, nid := range random.Perm(len(nodes))[:count] {
+		nodes[nid].Flood = floods[random.Intn(len(floods))]
+		persons[nid] = random.Intn(4)
+		changed = append(changed, nid)
+	}
+	sort.Ints(changed)
+	return changed
+}
+
+func testProfiles() map[string]routingProfile {
+	return newProfiles(aria_utility_settings.SettingRoutingEntity{FloodWeight: 1, SlopeWeight: 2, CongestionWeight: 0.5})
+}
+
+func compareTrees(t *testing.T, label string, got *routeTree, want *routeTree) {
+	t.Helper()
+	if !reflect.DeepEqual(got.next, want.next) || !reflect.DeepEqual(got.costs, want.costs) {
+		for nid, next := range want.next {
+			if got.next[nid] != next || got.costs[nid] != want.costs[nid] {
+				t.Fatalf("%s: node %d next %d cost %v, want next %d cost %v", label, nid, got.next[nid], got.costs[nid], next, want.costs[nid])
+			}
+		}
+		t.Fatalf("%s: %d reachable nodes, want %d", label, len(got.next), len(want.next))
+	}
+}
+
+// 水深や混雑が変わったノードだけを探索し直した木は、作り直した木と同じ
+func TestUpdateMatchesBuildTree(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for name, profile := range testProfiles() {
+		nodes := testMap(random)
+		shelters := map[int]int{}
+		persons := map[int]int{}
+		tree := buildTree(nodes, shelters, profile, persons)
+		for step := 0; step < 100; step++ {
+			changed := changeFloods(random, nodes, persons, 1+random.Intn(20))
+			tree = tree.update(nodes, profile, persons, changed)
+			compareTrees(t, name, tree, buildTree(nodes, shelters, profile, persons))
+		}
+	}
+}
+
+// 地図の変更（通行止め、避難場所の開設と閉鎖）と水深の変更を繰り返しても、各ステップの木は作り直した木と同じ
+func TestSnapshotMatchesBuildTree(t *testing.T) {
+	random := rand.New(rand.NewSource(2))
+	profiles := testProfiles()
+	nodes := testMap(random)
+	shelters := map[int]int{}
+	persons := map[int]int{}
+	events := aria_utility_nodes.MapEvents{}
+	version := 0
+	var snapshot *routeSnapshot
+	for step := 0; step < 100; step++ {
+		if step%5 == 4 {
+			types := []string{aria_utility_nodes.EventLinkClose, aria_utility_nodes.EventLinkOpen, aria_utility_nodes.EventShelterOpen, aria_utility_nodes.EventShelterClose}
+			event := aria_utility_nodes.MapEvent{Step: step, Type: types[random.Intn(len(types))]}
+			if event.Type == aria_utility_nodes.EventLinkClose || event.Type == aria_utility_nodes.EventLinkOpen {
+				event.Target = random.Intn(2 * testGridSize * (testGridSize - 1))
+			} else {
+				event.Target = random.Intn(len(nodes))
+			}
+			events.Add(event)
+			events.Apply(nodes, step)
+			version++
+			for nid, node := range nodes {
+				if node.IsShelter {
+					shelters[nid] = random.Intn(8)
+				}
+			}
+		}
+		changeFloods(random, nodes, persons, 1+random.Intn(20))
+
+		snapshot = newSnapshot(snapshot, version, nodes, shelters, persons, profiles)
+		copies := copyNodes(nodes)
+		for name, profile := range profiles {
+			compareTrees(t, name, snapshot.tree(name), buildTree(copies, shelters, profile, persons))
+		}
+	}
+}
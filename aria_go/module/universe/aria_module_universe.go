@@ -1,12 +1,9 @@
 package aria_module_universe
 
 import (
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"io"
-	"os"
-	"strconv"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,28 +15,93 @@ import (
 	"github.com/rs/xid"
 )
 
-// Cycleエージェント
-type Cycle struct {
-	AnnounceStep int
-	StepCount    int
-}
-
 // Personモジュール
 type PersonModule struct {
-	IsFinished bool
+	IsFinished     bool
+	Exchange       bool // 交換フェーズに参加する
+	IsExchanged    bool
+	IsCheckpointed bool      // 状態を保存した
+	LastHeartbeat  time.Time // 最後に生存を確認した時刻
+	IsPending      bool      // サイクルの途中で参加したので、次のサイクルから参加する
+	Session        string    // 参加したプロセスのID
+	Encodings      []string  // 受信できるペイロードの形式
+}
+
+// Personモジュールに割り当てたPersonのIDの範囲（離脱後も保持し、同じモジュールが再参加した場合に使う）
+type PersonRange struct {
+	From int
+	To   int
 }
 
+// チェックポイントに保存するUniverseの状態
+type UniverseCheckpoint struct {
+	Cycle        int
+	Step         int
+	PersonRanges map[string]PersonRange
+	PersonCount  int
+	Modules      []string // 状態を保存したPersonモジュール
+	ReplayIndex  int
+	Affected     int
+	Evacuated    int
+	Statuses     map[int]int `json:",omitempty"` // 前ステップのパーソンの状態（終了条件のSteadySteps用）
+	SteadySteps  int         `json:",omitempty"` // 状態が変化していないステップ数
+}
+
+// 完了を待っているフェーズ
+const (
+	phaseNone       = iota
+	phasePrepare    // サイクルの準備（aria/prepared待ち）
+	phaseExchange   // 交換フェーズ（aria/exchanged待ち）
+	phaseCompute    // 計算フェーズ（aria/persons待ち）
+	phaseCheckpoint // チェックポイント（aria/checkpointed待ち）
+)
+
+// サイクルを終了した理由
+const (
+	StopStepCount      = "step count"      // 設定ファイルのStepCountに達した
+	StopAllSettled     = "all settled"     // 全てのパーソンが被災か避難完了になった
+	StopSteady         = "steady"          // 全てのパーソンの状態が変化しなくなった
+	StopEvacuatedRatio = "evacuated ratio" // 避難完了の割合に達した
+	StopTimeBudget     = "time budget"     // サイクルの経過時間の上限に達した
+)
+
+// 制限時間を超えた場合の動作
+const (
+	TimeoutPolicyAbort = "abort" // 実行を中止する（既定）
+	TimeoutPolicySkip  = "skip"  // 応答のないモジュールを外して続ける
+	TimeoutPolicyRetry = "retry" // フェーズを再実行する
+)
+
 type UniverseModule struct {
 	CycleCount      int
 	StepCount       int
 	lastStep        time.Time
-	personModules   map[string]*PersonModule // 登録済みのPersonモジュール
-	cycles          []Cycle                  // 設定ファイルのCycle情報一覧
+	personModules   map[string]*PersonModule             // 登録済みのPersonモジュール
+	personRanges    map[string]PersonRange               // 割り当て済みのPersonのIDの範囲
+	personCount     int                                  // 割り当て済みのPersonの数
+	scenario        aria_utility_settings.ScenarioEntity // シナリオのサイクル一覧（設定ファイルのCycle情報一覧）
 	settings        aria_utility_settings.SettingEntity
+	topics          aria_utility_mqtt.Topics
 	client          MQTT.Client
-	Persons         []aria_utility_mqtt.AllEntity // 集計済みのPersonエージェント
+	Persons         []aria_utility_mqtt.AllEntity     // 集計済みのPersonエージェント
+	Shelters        []aria_utility_mqtt.ShelterEntity // 集計済みの避難場所の収容人数（ステップの完了時）
+	shelterReports  []aria_utility_mqtt.ShelterEntity // このステップに受信したモジュール毎の避難場所の人数
 	syncer          sync.WaitGroup
+	mutex           sync.Mutex                       // 受信ハンドラと監視goroutineの排他
+	phase           int                              // 完了を待っているフェーズ
+	phaseStart      time.Time                        // フェーズの開始時刻
+	retries         int                              // 現在のステップの再実行回数
+	replays         []aria_utility_mqtt.RecordEntity // 再生する外部入力の記録
+	replayIndex     int                              // 次に再生する記録
+	control         *universeControl                 // 遠隔操作（ControlAddressを設定した場合のみ）
+	restore         *UniverseCheckpoint              // 再開するチェックポイント（最初の準備フェーズが終わるまで）
+	cycleStart      time.Time                        // サイクルの開始時刻（終了条件のTimeBudget用）
+	statuses        map[int]int                      // 前ステップのパーソンの状態
+	steadySteps     int                              // 全てのパーソンの状態が変化していないステップ数
+	stop            chan bool
 	NeedsCycleStart bool
+	Aborted         bool   // 制限時間を超えて中止した
+	StopReason      string // 最後にサイクルを終了した理由
 	Affected        int
 	Evacuated       int
 }
@@ -53,40 +115,93 @@ func (universe *UniverseModule) Initialize(settings aria_utility_settings.Settin
 
 	// 共通設定ファイルの読み込み
 	universe.settings = settings
+	universe.topics = aria_utility_mqtt.NewTopics(settings.UniverseID, settings.LegacyTopics)
+	clientID := xid.New().String()
 
 	// 登録済みのPersonモジュール
 	universe.personModules = make(map[string]*PersonModule)
+	universe.personRanges = make(map[string]PersonRange)
 
-	// 設定ファイルの読み込み－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
-	file, _ := os.Open(settings.UniverseFilePath)
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1
-	reader.Read()
-	for {
-		line, e := reader.Read()
-		if e == io.EOF || len(line) < 2 {
-			break
+	// 再開するチェックポイントの読み込み（同じモジュール名で参加したモジュールに同じIDの範囲を割り当てる）
+	if settings.RestorePath != "" {
+		var checkpoint UniverseCheckpoint
+		if err := aria_utility_mqtt.LoadCheckpoint(settings.RestorePath, "universe", &checkpoint); err != nil {
+			panic(err)
 		}
+		universe.CycleCount = checkpoint.Cycle
+		universe.personRanges = checkpoint.PersonRanges
+		universe.personCount = checkpoint.PersonCount
+		universe.replayIndex = checkpoint.ReplayIndex
+		universe.Affected = checkpoint.Affected
+		universe.Evacuated = checkpoint.Evacuated
+		universe.restore = &checkpoint
+		fmt.Printf("[Universe] Restore Cycle %d Step %d (%s)\n", checkpoint.Cycle, checkpoint.Step, settings.RestorePath)
+	}
 
-		announceStep, _ := strconv.Atoi(line[0])
-		stepCount, _ := strconv.Atoi(line[1])
+	// 設定ファイル（シナリオ）の読み込み
+	scenario, err := aria_utility_settings.LoadScenario(settings)
+	if err != nil {
+		panic(err)
+	}
+	universe.scenario = scenario
 
-		universe.cycles = append(universe.cycles, Cycle{
-			AnnounceStep: announceStep,
-			StepCount:    stepCount,
-		})
+	// 再生する記録の読み込み（カメラやメッセージなど、外部からの入力のみ）
+	if settings.ReplayFilePath != "" {
+		records, err := aria_utility_mqtt.LoadRecords(settings.ReplayFilePath)
+		if err != nil {
+			panic(err)
+		}
+		for _, record := range records {
+			if universe.topics.ReplayTopic(record) != "" {
+				universe.replays = append(universe.replays, record)
+			}
+		}
+		fmt.Printf("[Universe] Replay %d messages (%s)\n", len(universe.replays), settings.ReplayFilePath)
 	}
-	// －－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
 
 	// パーソンエージェントの参加メッセージを受信
-	personCount := 0
 	var attendRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.AttendEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, universe.topics, clientID, msg, err)
+			return
+		}
+
+		universe.mutex.Lock()
+		defer universe.mutex.Unlock()
+
+		personModule, exists := universe.personModules[entity.ID]
+		if exists && entity.Active {
+			// 再接続（サイクルの状態を保持している）の場合は、そのまま続ける
+			personModule.LastHeartbeat = time.Now()
+			personModule.Session = entity.Session
+			personModule.Encodings = entity.Encodings
+		} else {
+			// 状態を失って再参加した場合は、現在のサイクルからは外す
+			if exists {
+				universe.removeModules([]string{entity.ID}, "rejoin")
+			}
 
-		// モジュールを登録
-		universe.personModules[entity.ID] = &PersonModule{
-			IsFinished: false,
+			// サイクルの実行中は、次のサイクルから参加する
+			universe.personModules[entity.ID] = &PersonModule{
+				IsFinished:    false,
+				Exchange:      entity.Exchange,
+				LastHeartbeat: time.Now(),
+				IsPending:     !universe.NeedsCycleStart || universe.phase == phasePrepare,
+				Session:       entity.Session,
+				Encodings:     entity.Encodings,
+			}
+		}
+
+		// IDの範囲を割り当て（再参加の場合は前回と同じ範囲）
+		personRange, exists := universe.personRanges[entity.ID]
+		if !exists || personRange.To-personRange.From != entity.Count {
+			personRange = PersonRange{
+				From: universe.personCount,
+				To:   universe.personCount + entity.Count,
+			}
+			universe.personRanges[entity.ID] = personRange
+			universe.personCount += entity.Count
 		}
 
 		// メッセージ出力
@@ -97,24 +212,36 @@ func (universe *UniverseModule) Initialize(settings aria_utility_settings.Settin
 		println("]")
 
 		// 登録されたことをPublish
-		bytes, _ := json.Marshal(aria_utility_mqtt.RegisteredEntity{
-			ID:   entity.ID,
-			From: personCount,
-			To:   personCount + entity.Count,
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.RegisteredEntity{
+			ID:       entity.ID,
+			From:     personRange.From,
+			To:       personRange.To,
+			Encoding: universe.encoding(entity.Encodings),
 		})
-		token := client.Publish(fmt.Sprintf("aria/registered/%s/%s", universe.settings.UniverseID, entity.ID), 0, false, bytes)
+		token := client.Publish(universe.topics.Registered(entity.ID), 0, false, bytes)
 		token.Wait()
-
-		personCount += entity.Count
 	}
 
 	// パーソンエージェントのサイクル準備完了メッセージを受信
 	var preparedRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
 		var entity aria_utility_mqtt.PreparedEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, universe.topics, clientID, msg, err)
+			return
+		}
+
+		universe.mutex.Lock()
+		defer universe.mutex.Unlock()
+
+		// 準備中でない場合、離脱したモジュール、再実行で重複した応答は無視する
+		personModule, exists := universe.personModules[entity.ID]
+		if !exists || universe.phase != phasePrepare || personModule.IsPending || personModule.IsFinished {
+			return
+		}
 
 		// このモジュールが完了したことを記録
-		universe.personModules[entity.ID].IsFinished = true
+		personModule.IsFinished = true
+		personModule.LastHeartbeat = time.Now()
 
 		// パーソンエージェントを追加
 		for _, person := range entity.Persons {
@@ -128,24 +255,50 @@ func (universe *UniverseModule) Initialize(settings aria_utility_settings.Settin
 			})
 		}
 
-		// 全てのモジュールが終わっていない場合は終了
-		for _, personModule := range universe.personModules {
-			if !personModule.IsFinished {
-				return
-			}
+		universe.checkPrepared()
+	}
+
+	// パーソンエージェントの交換フェーズ完了メッセージを受信
+	var exchangedRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.ExchangedEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, universe.topics, clientID, msg, err)
+			return
+		}
+
+		universe.mutex.Lock()
+		defer universe.mutex.Unlock()
+
+		personModule, exists := universe.personModules[entity.ID]
+		if !exists || universe.phase != phaseExchange || personModule.IsPending || entity.Count != universe.StepCount {
+			return
 		}
+		personModule.IsExchanged = true
+		personModule.LastHeartbeat = time.Now()
 
-		universe.NeedsCycleStart = false
-		universe.syncer.Done()
+		universe.checkExchanged()
 	}
 
 	// パーソンエージェントのステップ完了メッセージを受信
 	var stepRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
-		var entity aria_utility_mqtt.StepEntity
-		json.Unmarshal(msg.Payload(), &entity)
+		entity, err := aria_utility_mqtt.DecodeStep(msg.Payload())
+		if err != nil {
+			aria_utility_mqtt.ReportError(client, universe.topics, clientID, msg, err)
+			return
+		}
+
+		universe.mutex.Lock()
+		defer universe.mutex.Unlock()
+
+		// 計算中でない場合、離脱したモジュール、別のステップ、再実行で重複した応答は無視する
+		personModule, exists := universe.personModules[entity.ID]
+		if !exists || universe.phase != phaseCompute || personModule.IsPending || entity.Count != universe.StepCount || personModule.IsFinished {
+			return
+		}
 
 		// このモジュールが完了したことを記録
-		universe.personModules[entity.ID].IsFinished = true
+		personModule.IsFinished = true
+		personModule.LastHeartbeat = time.Now()
 
 		// パーソンエージェントを追加
 		for _, person := range entity.Persons {
@@ -158,74 +311,88 @@ func (universe *UniverseModule) Initialize(settings aria_utility_settings.Settin
 				InfoAccess: person.InfoAccess,
 			})
 		}
+		universe.shelterReports = append(universe.shelterReports, entity.Shelters...)
 
-		// 全てのパーソンモジュールが終わっていない場合は終了
-		for _, personModule := range universe.personModules {
-			if !personModule.IsFinished {
-				return
-			}
+		universe.checkStep()
+	}
+
+	// パーソンエージェントの状態の保存完了メッセージを受信
+	var checkpointedRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.CheckpointedEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, universe.topics, clientID, msg, err)
+			return
 		}
 
-		//allをPublish
-		bytes, _ := json.Marshal(universe.Persons)
-		token := client.Publish("/person/send/all", 0, false, bytes)
-		token.Wait()
+		universe.mutex.Lock()
+		defer universe.mutex.Unlock()
 
-		// 洪水情報の処理（洪水情報をここで管理する必要は本当は無い）
-		_, total, max := aria_utility_floods.LoadFloods(universe.settings, 0, 0, universe.StepCount)
+		personModule, exists := universe.personModules[entity.ID]
+		if !exists || universe.phase != phaseCheckpoint || personModule.IsPending || entity.Step != universe.StepCount {
+			return
+		}
+		personModule.IsCheckpointed = true
+		personModule.LastHeartbeat = time.Now()
 
-		// 被災状況を計算
-		universe.Affected = 0
-		universe.Evacuated = 0
-		for _, person := range universe.Persons {
-			if person.Status == 6 {
-				universe.Affected++
-			}
-			if person.Status == 7 {
-				universe.Evacuated++
-			}
+		universe.checkCheckpointed()
+	}
+
+	// パーソンエージェントの生存通知を受信
+	var heartbeatRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.HeartbeatEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, universe.topics, clientID, msg, err)
+			return
 		}
 
-		// statをPublish
-		bytes, _ = json.Marshal(aria_utility_mqtt.StatusEntity{
-			AffectedPerson:  universe.Affected,
-			EvacuatedPerson: universe.Evacuated,
-			TotalFlood:      total,
-			MaxFlood:        max,
-		})
-		token = client.Publish("/stat/send", 0, false, bytes)
-		token.Wait()
-		// fmt.Printf("Affected : %d\n", universe.Affected)
-		// fmt.Printf("Evacuated: %d\n\n", universe.Evacuated)
-
-		if universe.settings.MinimumStepTime >= 0 {
-			// 指定時間が経過するまで待つ
-			sleep := universe.settings.MinimumStepTime - int(time.Now().Sub(universe.lastStep).Milliseconds())
-			if sleep > 0 {
-				time.Sleep(time.Duration(sleep) * time.Millisecond)
-			}
-		} else {
-			fmt.Scanln()
+		universe.mutex.Lock()
+		defer universe.mutex.Unlock()
+
+		if personModule, exists := universe.personModules[entity.ID]; exists && personModule.Session == entity.Session {
+			personModule.LastHeartbeat = time.Now()
 		}
+	}
 
-		universe.StepCount++
-		if universe.StepCount >= universe.cycles[universe.CycleCount%len(universe.cycles)].StepCount {
-			universe.CycleCount++
-			universe.NeedsCycleStart = true
+	// パーソンエージェントの離脱通知を受信（異常切断の場合はWillメッセージとして届く）
+	var leaveRecieved MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		var entity aria_utility_mqtt.LeaveEntity
+		if err := aria_utility_mqtt.Decode(msg.Payload(), &entity); err != nil {
+			aria_utility_mqtt.ReportError(client, universe.topics, clientID, msg, err)
+			return
 		}
-		universe.syncer.Done()
+
+		universe.mutex.Lock()
+		defer universe.mutex.Unlock()
+
+		// 再起動前のプロセスからの離脱通知（Willメッセージなど）は無視する
+		if personModule, exists := universe.personModules[entity.ID]; !exists || personModule.Session != entity.Session {
+			return
+		}
+		universe.removeModules([]string{entity.ID}, "leave")
 	}
 
 	// MQTTクライアントの設定
-	opts := MQTT.NewClientOptions().AddBroker(universe.settings.BrokerAddress).SetClientID(xid.New().String())
+	opts := MQTT.NewClientOptions().AddBroker(universe.settings.BrokerAddress).SetClientID(clientID)
 	opts.OnConnect = func(client MQTT.Client) {
-		if token := client.Subscribe(fmt.Sprintf("aria/attend/%s", universe.settings.UniverseID), 0, attendRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(universe.topics.Attend(), 0, attendRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(universe.topics.Prepared(), 0, preparedRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(universe.topics.Exchanged(), 0, exchangedRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(universe.topics.Persons(), 0, stepRecieved); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		if token := client.Subscribe(universe.topics.Checkpointed(), 0, checkpointedRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe(fmt.Sprintf("aria/prepared/%s", universe.settings.UniverseID), 0, preparedRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(universe.topics.Heartbeat(), 0, heartbeatRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
-		if token := client.Subscribe(fmt.Sprintf("aria/persons/%s", universe.settings.UniverseID), 0, stepRecieved); token.Wait() && token.Error() != nil {
+		if token := client.Subscribe(universe.topics.Leave(), 0, leaveRecieved); token.Wait() && token.Error() != nil {
 			panic(token.Error())
 		}
 		fmt.Printf("[Universe] Initialized (%s)\n", opts.ClientID)
@@ -233,21 +400,40 @@ func (universe *UniverseModule) Initialize(settings aria_utility_settings.Settin
 	}
 
 	// MQTTブローカーに接続
-	universe.client = MQTT.NewClient(opts)
+	universe.client = aria_utility_mqtt.NewClient(universe.settings.Transport, opts)
 	if token := universe.client.Connect(); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
 
+	// 生存通知と制限時間の監視
+	universe.stop = make(chan bool)
+	go universe.watch()
+
+	// 遠隔操作のHTTP API
+	if settings.ControlAddress != "" {
+		universe.startControl(settings.ControlAddress)
+	}
+
 	return &syncer
 }
 
 func (universe *UniverseModule) Uninitialize() {
+	close(universe.stop)
+	if universe.control != nil {
+		universe.control.server.Close()
+	}
 	universe.client.Disconnect(250)
 	fmt.Println("[Universe] Uninitialize")
 }
 
 // サイクルの開始をPublish
 func (universe *UniverseModule) PublishCycle() *sync.WaitGroup {
+	universe.mutex.Lock()
+	defer universe.mutex.Unlock()
+
+	if universe.Aborted {
+		return &universe.syncer
+	}
 	if !universe.NeedsCycleStart {
 		fmt.Printf("TODO : argument error\n")
 		return &universe.syncer
@@ -256,23 +442,73 @@ func (universe *UniverseModule) PublishCycle() *sync.WaitGroup {
 	universe.syncer.Add(1)
 
 	universe.StepCount = 0
+	universe.retries = 0
+	universe.cycleStart = time.Now()
+	universe.statuses = make(map[int]int)
+	universe.steadySteps = 0
+	universe.Shelters = nil
 	for _, personModule := range universe.personModules {
 		personModule.IsFinished = false
+		personModule.IsPending = false
 	}
-	bytes, _ := json.Marshal(aria_utility_mqtt.CycleEntity{
-		AnnounceStep: universe.cycles[universe.CycleCount%len(universe.cycles)].AnnounceStep,
-	})
-	if token := universe.client.Publish(fmt.Sprintf("aria/cycle/%s", universe.settings.UniverseID), 0, false, bytes); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+
+	// チェックポイントから再開する場合は、保存したステップから始める
+	if universe.restore != nil {
+		universe.StepCount = universe.restore.Step
+		if universe.restore.Statuses != nil {
+			universe.statuses = universe.restore.Statuses
+		}
+		universe.steadySteps = universe.restore.SteadySteps
+		for _, id := range universe.restore.Modules {
+			if _, exists := universe.personModules[id]; !exists {
+				fmt.Printf("[Universe] Person Module Not Restored : %s\n", id)
+			}
+		}
+	}
+	universe.publishCycle()
+	if cycle := universe.scenario.Cycle(universe.CycleCount); cycle.Name != "" {
+		fmt.Printf("[Universe] Cycle %d : %s\n", universe.CycleCount, cycle.Name)
 	}
-	// fmt.Printf("--- Cycle %d Start (Annnounce %d Step)---\n", universe.CycleCount, universe.cycles[universe.CycleCount%len(universe.cycles)].AnnounceStep)
 	universe.lastStep = time.Now()
 
 	return &universe.syncer
 }
 
+// 準備フェーズ（サイクルの開始）をPublish
+func (universe *UniverseModule) publishCycle() {
+	universe.phase = phasePrepare
+	universe.phaseStart = time.Now()
+
+	// チェックポイントから再開する場合は、サイクルの開始の代わりに状態の読み込みを指示する
+	if universe.restore != nil {
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.CheckpointEntity{
+			Cycle: universe.restore.Cycle,
+			Step:  universe.restore.Step,
+			Path:  universe.settings.RestorePath,
+		})
+		if token := universe.client.Publish(universe.topics.Restore(), 0, false, bytes); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+		return
+	}
+
+	bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.CycleEntity{
+		AnnounceStep: universe.scenario.Cycle(universe.CycleCount).AnnounceStep,
+		Cycle:        universe.CycleCount,
+	})
+	if token := universe.client.Publish(universe.topics.Cycle(), 0, false, bytes); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+}
+
 // ステップの開始をPublish
 func (universe *UniverseModule) PublishStep() *sync.WaitGroup {
+	universe.mutex.Lock()
+	defer universe.mutex.Unlock()
+
+	if universe.Aborted {
+		return &universe.syncer
+	}
 	if universe.NeedsCycleStart {
 		fmt.Printf("TODO : argument error\n")
 		return &universe.syncer
@@ -280,18 +516,463 @@ func (universe *UniverseModule) PublishStep() *sync.WaitGroup {
 
 	universe.syncer.Add(1)
 
+	universe.retries = 0
 	for _, personModule := range universe.personModules {
 		personModule.IsFinished = false
+		personModule.IsExchanged = false
 	}
 	universe.Persons = universe.Persons[:0]
-	bytes, _ := json.Marshal(aria_utility_mqtt.CountEntity{
+	universe.shelterReports = universe.shelterReports[:0]
+	universe.lastStep = time.Now()
+	universe.publishReplays()
+	universe.publishEvents()
+	universe.publishExchange()
+
+	return &universe.syncer
+}
+
+// シナリオの地図の変更のうち、現在のステップのものをPublish（ステップの開始より先に届く）
+func (universe *UniverseModule) publishEvents() {
+	for _, event := range universe.scenario.Cycle(universe.CycleCount).Events {
+		if event.Step != universe.StepCount {
+			continue
+		}
+		bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.EventEntity{
+			Step:   event.Step,
+			Type:   event.Type,
+			Target: event.Target,
+		})
+		if token := universe.client.Publish(universe.topics.Event(), 0, false, bytes); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+	}
+}
+
+// 記録した外部入力のうち、現在のステップより前に受信したものをPublish
+// 記録した時と同じく、各モジュールにはこのステップの開始より先に届く
+func (universe *UniverseModule) publishReplays() {
+	for universe.replayIndex < len(universe.replays) && universe.replays[universe.replayIndex].Before(universe.CycleCount, universe.StepCount) {
+		record := universe.replays[universe.replayIndex]
+		universe.replayIndex++
+		if token := universe.client.Publish(universe.topics.ReplayTopic(record), 0, false, record.PayloadBytes()); token.Wait() && token.Error() != nil {
+			panic(token.Error())
+		}
+	}
+}
+
+// 交換フェーズの開始をPublish（全てのモジュールが前ステップの状態を揃えてから計算フェーズに進む）
+func (universe *UniverseModule) publishExchange() {
+	exchanges := []string{}
+	encodings := aria_utility_mqtt.Encodings
+	for id, personModule := range universe.personModules {
+		if personModule.Exchange && !personModule.IsPending {
+			exchanges = append(exchanges, id)
+
+			// 全てのモジュールが受信できる形式を使う
+			if !aria_utility_mqtt.SupportsEncoding(personModule.Encodings, aria_utility_mqtt.EncodingBinary) {
+				encodings = []string{aria_utility_mqtt.EncodingJSON}
+			}
+		}
+	}
+	sort.Strings(exchanges)
+
+	// 交換フェーズがなければ、すぐに計算フェーズを開始
+	if len(exchanges) == 0 {
+		universe.publishCount()
+		return
+	}
+
+	universe.phase = phaseExchange
+	universe.phaseStart = time.Now()
+	bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.ExchangeEntity{
+		Count:    universe.StepCount,
+		Modules:  exchanges,
+		Encoding: universe.encoding(encodings),
+	})
+	if token := universe.client.Publish(universe.topics.Exchange(), 0, false, bytes); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+}
+
+// 計算フェーズ（ステップの開始）をPublish
+func (universe *UniverseModule) publishCount() {
+	universe.phase = phaseCompute
+	universe.phaseStart = time.Now()
+	bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.CountEntity{
 		Count: universe.StepCount,
 	})
-	if token := universe.client.Publish("/flood/count", 0, false, bytes); token.Wait() && token.Error() != nil {
+	if token := universe.client.Publish(universe.topics.Count(), 0, false, bytes); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
 	// fmt.Printf("--- Step %d Start (%d ms)---\n", universe.StepCount, time.Now().Sub(universe.lastStep).Milliseconds())
-	universe.lastStep = time.Now()
+}
 
-	return &universe.syncer
+// 設定された形式を相手が受信できればその形式、それ以外はJSON
+func (universe *UniverseModule) encoding(encodings []string) string {
+	if universe.settings.Encoding == aria_utility_mqtt.EncodingBinary && aria_utility_mqtt.SupportsEncoding(encodings, aria_utility_mqtt.EncodingBinary) {
+		return aria_utility_mqtt.EncodingBinary
+	}
+	return aria_utility_mqtt.EncodingJSON
+}
+
+// 全てのモジュールの準備が完了していればサイクルを開始する
+func (universe *UniverseModule) checkPrepared() {
+	for _, personModule := range universe.personModules {
+		if !personModule.IsPending && !personModule.IsFinished {
+			return
+		}
+	}
+
+	universe.phase = phaseNone
+	universe.NeedsCycleStart = false
+	universe.restore = nil
+	universe.syncer.Done()
+}
+
+// 全てのモジュールが前ステップの状態を受け取っていれば計算フェーズを開始する
+func (universe *UniverseModule) checkExchanged() {
+	for _, personModule := range universe.personModules {
+		if personModule.Exchange && !personModule.IsPending && !personModule.IsExchanged {
+			return
+		}
+	}
+
+	universe.publishCount()
+}
+
+// 全てのモジュールの計算が完了していればステップを完了する
+func (universe *UniverseModule) checkStep() {
+	for _, personModule := range universe.personModules {
+		if !personModule.IsPending && !personModule.IsFinished {
+			return
+		}
+	}
+
+	universe.phase = phaseNone
+
+	//allをPublish
+	bytes, _ := json.Marshal(universe.Persons)
+	token := universe.client.Publish(universe.topics.All(), 0, false, bytes)
+	token.Wait()
+
+	// 洪水情報の処理（洪水情報をここで管理する必要は本当は無い）
+	_, total, max := aria_utility_floods.LoadFloods(universe.scenario.Cycle(universe.CycleCount).Apply(universe.settings), 0, 0, universe.StepCount)
+
+	// 被災状況を計算
+	universe.Affected = 0
+	universe.Evacuated = 0
+	for _, person := range universe.Persons {
+		if person.Status == 6 {
+			universe.Affected++
+		}
+		if person.Status == 7 {
+			universe.Evacuated++
+		}
+	}
+
+	// statをPublish
+	bytes = aria_utility_mqtt.Encode(&aria_utility_mqtt.StatusEntity{
+		AffectedPerson:  universe.Affected,
+		EvacuatedPerson: universe.Evacuated,
+		TotalFlood:      total,
+		MaxFlood:        max,
+	})
+	token = universe.client.Publish(universe.topics.Stat(), 0, false, bytes)
+	token.Wait()
+	universe.publishShelters()
+	// fmt.Printf("Affected : %d\n", universe.Affected)
+	// fmt.Printf("Evacuated: %d\n\n", universe.Evacuated)
+
+	universe.StepCount++
+	if reason := universe.stopReason(); reason != "" {
+		if reason != StopStepCount {
+			fmt.Printf("[Universe] Cycle %d Stopped at Step %d (%s)\n", universe.CycleCount, universe.StepCount, reason)
+		}
+		universe.StopReason = reason
+		universe.CycleCount++
+		universe.NeedsCycleStart = true
+	}
+
+	// 指定した間隔で、次のステップの開始前の状態を保存する（サイクルの境目では保存しない）
+	if universe.settings.CheckpointInterval > 0 && !universe.NeedsCycleStart && universe.StepCount%universe.settings.CheckpointInterval == 0 {
+		for _, personModule := range universe.personModules {
+			personModule.IsCheckpointed = false
+		}
+		universe.publishCheckpoint()
+		return
+	}
+	universe.syncer.Done()
+}
+
+// 避難場所の収容人数を集計してPublish（各モジュールは次のステップの受け入れと経路計算に使う）
+func (universe *UniverseModule) publishShelters() {
+	type shelterKey struct {
+		nid  int
+		path string
+	}
+	totals := make(map[shelterKey]*aria_utility_mqtt.ShelterEntity)
+	for _, report := range universe.shelterReports {
+		key := shelterKey{report.NID, report.Map}
+		total, exists := totals[key]
+		if !exists {
+			total = &aria_utility_mqtt.ShelterEntity{NID: report.NID, Map: report.Map}
+			totals[key] = total
+		}
+		total.Occupancy += report.Occupancy
+		if total.Capacity < report.Capacity {
+			total.Capacity = report.Capacity
+		}
+	}
+	universe.Shelters = []aria_utility_mqtt.ShelterEntity{}
+	for _, total := range totals {
+		universe.Shelters = append(universe.Shelters, *total)
+	}
+	sort.Slice(universe.Shelters, func(i, j int) bool {
+		if universe.Shelters[i].Map != universe.Shelters[j].Map {
+			return universe.Shelters[i].Map < universe.Shelters[j].Map
+		}
+		return universe.Shelters[i].NID < universe.Shelters[j].NID
+	})
+
+	// 避難場所のないシミュレーションでは何もしない
+	if len(universe.Shelters) == 0 {
+		return
+	}
+	bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.SheltersEntity{
+		Count:    universe.StepCount,
+		Shelters: universe.Shelters,
+	})
+	if token := universe.client.Publish(universe.topics.Shelters(), 0, false, bytes); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+}
+
+// サイクルを終了する理由（終了しない場合は空）
+func (universe *UniverseModule) stopReason() string {
+	criteria := universe.settings.StopCriteria
+
+	// 前ステップから状態が変化したパーソンがいるか
+	isChanged := false
+	for _, person := range universe.Persons {
+		if status, exists := universe.statuses[person.ID]; !exists || status != person.Status {
+			isChanged = true
+		}
+		universe.statuses[person.ID] = person.Status
+	}
+	if isChanged {
+		universe.steadySteps = 0
+	} else {
+		universe.steadySteps++
+	}
+
+	if universe.StepCount >= universe.scenario.Cycle(universe.CycleCount).StepCount {
+		return StopStepCount
+	}
+	if len(universe.Persons) == 0 {
+		return ""
+	}
+	if criteria.AllSettled && universe.Affected+universe.Evacuated == len(universe.Persons) {
+		return StopAllSettled
+	}
+	if criteria.SteadySteps > 0 && universe.steadySteps >= criteria.SteadySteps {
+		return StopSteady
+	}
+	if criteria.EvacuatedRatio > 0 && float64(universe.Evacuated) >= criteria.EvacuatedRatio*float64(len(universe.Persons)) {
+		return StopEvacuatedRatio
+	}
+	if criteria.TimeBudget > 0 && time.Now().Sub(universe.cycleStart) >= time.Duration(criteria.TimeBudget)*time.Millisecond {
+		return StopTimeBudget
+	}
+	return ""
+}
+
+// チェックポイント（状態の保存）をPublish
+func (universe *UniverseModule) publishCheckpoint() {
+	universe.phase = phaseCheckpoint
+	universe.phaseStart = time.Now()
+	bytes := aria_utility_mqtt.Encode(&aria_utility_mqtt.CheckpointEntity{
+		Cycle: universe.CycleCount,
+		Step:  universe.StepCount,
+		Path:  aria_utility_mqtt.CheckpointDirectory(universe.settings.CheckpointPath, universe.CycleCount, universe.StepCount),
+	})
+	if token := universe.client.Publish(universe.topics.Checkpoint(), 0, false, bytes); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+	universe.checkCheckpointed()
+}
+
+// 全てのモジュールが状態を保存していれば、Universeの状態を保存してステップを完了する
+func (universe *UniverseModule) checkCheckpointed() {
+	modules := []string{}
+	for id, personModule := range universe.personModules {
+		if personModule.IsPending {
+			continue
+		}
+		if !personModule.IsCheckpointed {
+			return
+		}
+		modules = append(modules, id)
+	}
+	sort.Strings(modules)
+
+	directory := aria_utility_mqtt.CheckpointDirectory(universe.settings.CheckpointPath, universe.CycleCount, universe.StepCount)
+	err := aria_utility_mqtt.SaveCheckpoint(directory, "universe", UniverseCheckpoint{
+		Cycle:        universe.CycleCount,
+		Step:         universe.StepCount,
+		PersonRanges: universe.personRanges,
+		PersonCount:  universe.personCount,
+		Modules:      modules,
+		ReplayIndex:  universe.replayIndex,
+		Affected:     universe.Affected,
+		Evacuated:    universe.Evacuated,
+		Statuses:     universe.statuses,
+		SteadySteps:  universe.steadySteps,
+	})
+	if err != nil {
+		fmt.Printf("[Universe] Checkpoint Failed : %v\n", err)
+	} else {
+		fmt.Printf("[Universe] Checkpoint : %s\n", directory)
+	}
+
+	universe.phase = phaseNone
+	universe.syncer.Done()
+}
+
+// 完了を待っているモジュールの一覧
+func (universe *UniverseModule) waitingModules() []string {
+	ids := []string{}
+	for id, personModule := range universe.personModules {
+		if personModule.IsPending {
+			continue
+		}
+		switch universe.phase {
+		case phasePrepare, phaseCompute:
+			if !personModule.IsFinished {
+				ids = append(ids, id)
+			}
+		case phaseExchange:
+			if personModule.Exchange && !personModule.IsExchanged {
+				ids = append(ids, id)
+			}
+		case phaseCheckpoint:
+			if !personModule.IsCheckpointed {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// モジュールを外して、残りのモジュールで現在のフェーズを続ける
+func (universe *UniverseModule) removeModules(ids []string, reason string) {
+	removed := false
+	for _, id := range ids {
+		if _, exists := universe.personModules[id]; exists {
+			delete(universe.personModules, id)
+			fmt.Printf("[Universe] Person Module Removed : %s (%s)\n", id, reason)
+			removed = true
+		}
+	}
+	if !removed {
+		return
+	}
+
+	switch universe.phase {
+	case phasePrepare:
+		universe.checkPrepared()
+	case phaseExchange:
+		// 外したモジュールの状態を待っているモジュールがあるので、残りのモジュールで交換フェーズをやり直す
+		if len(universe.waitingModules()) > 0 {
+			universe.publishExchange()
+		} else {
+			universe.checkExchanged()
+		}
+	case phaseCompute:
+		universe.checkStep()
+	case phaseCheckpoint:
+		universe.checkCheckpointed()
+	}
+}
+
+// 生存通知と制限時間の監視
+func (universe *UniverseModule) watch() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-universe.stop:
+			return
+		case <-ticker.C:
+		}
+
+		universe.mutex.Lock()
+		universe.checkTimeout()
+		universe.mutex.Unlock()
+	}
+}
+
+// 生存通知が途絶えたモジュールを外し、フェーズが制限時間を超えていれば設定された動作を行う
+func (universe *UniverseModule) checkTimeout() {
+	if universe.phase == phaseNone {
+		return
+	}
+	now := time.Now()
+
+	// フェーズの外（ステップ間の待ち時間など）は生存通知の途絶えた時間に含めない
+	if universe.settings.HeartbeatTimeout > 0 {
+		ids := []string{}
+		for id, personModule := range universe.personModules {
+			last := personModule.LastHeartbeat
+			if last.Before(universe.phaseStart) {
+				last = universe.phaseStart
+			}
+			if now.Sub(last) > time.Duration(universe.settings.HeartbeatTimeout)*time.Millisecond {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		universe.removeModules(ids, "heartbeat timeout")
+		if universe.phase == phaseNone {
+			return
+		}
+	}
+
+	if universe.settings.StepTimeout <= 0 || now.Sub(universe.phaseStart) <= time.Duration(universe.settings.StepTimeout)*time.Millisecond {
+		return
+	}
+	switch universe.settings.TimeoutPolicy {
+	case TimeoutPolicySkip:
+		universe.removeModules(universe.waitingModules(), "step timeout")
+	case TimeoutPolicyRetry:
+		if universe.retries >= universe.settings.StepRetryCount {
+			universe.abort("step timeout, retry count exceeded")
+			return
+		}
+		universe.retries++
+		fmt.Printf("[Universe] Step %d Retry (%d/%d) : %v\n", universe.StepCount, universe.retries, universe.settings.StepRetryCount, universe.waitingModules())
+
+		// 完了済みのモジュールは重複した要求を無視するか、前回の結果を再送する
+		switch universe.phase {
+		case phasePrepare:
+			universe.publishCycle()
+		case phaseExchange:
+			universe.publishExchange()
+		case phaseCompute:
+			universe.publishCount()
+		case phaseCheckpoint:
+			universe.publishCheckpoint()
+		}
+	default:
+		universe.abort("step timeout")
+	}
+}
+
+// 実行を中止する
+func (universe *UniverseModule) abort(reason string) {
+	fmt.Printf("[Universe] Aborted at Cycle %d Step %d (%s) : %v\n", universe.CycleCount, universe.StepCount, reason, universe.waitingModules())
+	universe.phase = phaseNone
+	universe.Aborted = true
+	universe.NeedsCycleStart = true
+	universe.syncer.Done()
 }
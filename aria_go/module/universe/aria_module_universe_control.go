@@ -0,0 +1,243 @@
+package aria_module_universe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 遠隔操作の状態
+const (
+	ControlWaiting = "waiting" // 開始待ち
+	ControlRunning = "running" // 実行中
+	ControlPaused  = "paused"  // 一時停止中
+	ControlStopped = "stopped" // 停止した
+	ControlAborted = "aborted" // 制限時間を超えて中止した
+)
+
+// ControlStatus 遠隔操作のHTTP APIの応答
+type ControlStatus struct {
+	State      string   `json:"state"`
+	Cycle      int      `json:"cycle"`
+	Step       int      `json:"step"`
+	Affected   int      `json:"affected"`
+	Evacuated  int      `json:"evacuated"`
+	StepTime   int      `json:"stepTime"`   // ステップの最小時間（ミリ秒）
+	Modules    []string `json:"modules"`    // 参加しているPersonモジュール
+	StopReason string   `json:"stopReason"` // 最後にサイクルを終了した理由
+}
+
+// ControlStepTimeEntity /steptimeの要求
+type ControlStepTimeEntity struct {
+	StepTime int `json:"stepTime"`
+}
+
+// universeControl 遠隔操作（HTTP/JSON）による実行の制御
+type universeControl struct {
+	mutex     sync.Mutex
+	condition *sync.Cond
+	isStarted bool
+	isPaused  bool
+	isStopped bool
+	steps     int // 一時停止中に実行するステップ数
+	stepTime  int // ステップの最小時間（ミリ秒）
+	server    *http.Server
+}
+
+// startControl 遠隔操作のHTTP APIを開始する
+//
+//	GET  /status   現在の状態
+//	POST /start    サイクルの実行を開始する
+//	POST /pause    次のステップの前で一時停止する
+//	POST /step     一時停止して、1ステップだけ実行する
+//	POST /resume   一時停止を解除する
+//	POST /steptime ステップの最小時間を変更する（{"stepTime": ミリ秒}）
+//	POST /stop     次のステップの前で停止する
+func (universe *UniverseModule) startControl(address string) {
+	control := &universeControl{
+		stepTime: universe.settings.MinimumStepTime,
+	}
+	control.condition = sync.NewCond(&control.mutex)
+
+	// ステップ毎に入力を待つ設定の場合は、一時停止した状態で開始する
+	if control.stepTime < 0 {
+		control.stepTime = 0
+		control.isPaused = true
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", universe.controlHandler(http.MethodGet, func(control *universeControl, r *http.Request) error {
+		return nil
+	}))
+	mux.HandleFunc("/start", universe.controlHandler(http.MethodPost, func(control *universeControl, r *http.Request) error {
+		control.isStarted = true
+		return nil
+	}))
+	mux.HandleFunc("/pause", universe.controlHandler(http.MethodPost, func(control *universeControl, r *http.Request) error {
+		control.isPaused = true
+		return nil
+	}))
+	mux.HandleFunc("/step", universe.controlHandler(http.MethodPost, func(control *universeControl, r *http.Request) error {
+		// 開始前の場合は、開始して最初のステップの後で一時停止する
+		if !control.isStarted {
+			control.isStarted = true
+		} else {
+			control.steps++
+		}
+		control.isPaused = true
+		return nil
+	}))
+	mux.HandleFunc("/resume", universe.controlHandler(http.MethodPost, func(control *universeControl, r *http.Request) error {
+		control.isStarted = true
+		control.isPaused = false
+		control.steps = 0
+		return nil
+	}))
+	mux.HandleFunc("/steptime", universe.controlHandler(http.MethodPost, func(control *universeControl, r *http.Request) error {
+		var entity ControlStepTimeEntity
+		if err := json.NewDecoder(r.Body).Decode(&entity); err != nil {
+			return err
+		}
+		if entity.StepTime < 0 {
+			return fmt.Errorf("stepTime: %d is less than 0", entity.StepTime)
+		}
+		control.stepTime = entity.StepTime
+		return nil
+	}))
+	mux.HandleFunc("/stop", universe.controlHandler(http.MethodPost, func(control *universeControl, r *http.Request) error {
+		control.isStopped = true
+		return nil
+	}))
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		panic(err)
+	}
+	control.server = &http.Server{Handler: mux}
+	go control.server.Serve(listener)
+
+	universe.control = control
+	fmt.Printf("[Universe] Control API (%s)\n", listener.Addr())
+}
+
+// controlHandler 遠隔操作の要求を処理して、現在の状態を返す（ダッシュボードから呼べるようにCORSを許可する）
+func (universe *UniverseModule) controlHandler(method string, operation func(control *universeControl, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method != method {
+			http.Error(w, fmt.Sprintf("%s only", method), http.StatusMethodNotAllowed)
+			return
+		}
+
+		control := universe.control
+		control.mutex.Lock()
+		err := operation(control, r)
+		control.condition.Broadcast()
+		control.mutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(universe.Status())
+	}
+}
+
+// Status 現在の状態
+func (universe *UniverseModule) Status() ControlStatus {
+	universe.mutex.Lock()
+	status := ControlStatus{
+		State:      ControlRunning,
+		Cycle:      universe.CycleCount,
+		Step:       universe.StepCount,
+		Affected:   universe.Affected,
+		Evacuated:  universe.Evacuated,
+		StepTime:   universe.settings.MinimumStepTime,
+		Modules:    []string{},
+		StopReason: universe.StopReason,
+	}
+	for id := range universe.personModules {
+		status.Modules = append(status.Modules, id)
+	}
+	aborted := universe.Aborted
+	universe.mutex.Unlock()
+	sort.Strings(status.Modules)
+
+	if control := universe.control; control != nil {
+		control.mutex.Lock()
+		status.StepTime = control.stepTime
+		switch {
+		case control.isStopped:
+			status.State = ControlStopped
+		case !control.isStarted:
+			status.State = ControlWaiting
+		case control.isPaused:
+			status.State = ControlPaused
+		}
+		control.mutex.Unlock()
+	}
+	if aborted {
+		status.State = ControlAborted
+	}
+	return status
+}
+
+// WaitStart サイクルの実行の開始を待つ（遠隔操作がなければ入力待ち、停止した場合はfalse）
+func (universe *UniverseModule) WaitStart() bool {
+	control := universe.control
+	if control == nil {
+		fmt.Scanln()
+		return true
+	}
+
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+	for !control.isStarted && !control.isStopped {
+		control.condition.Wait()
+	}
+	return !control.isStopped
+}
+
+// WaitStep 次のステップの開始を待つ（ステップの最小時間と一時停止、停止した場合はfalse）
+// 遠隔操作がなく、MinimumStepTimeが負の場合は入力待ち
+func (universe *UniverseModule) WaitStep() bool {
+	stepTime := universe.settings.MinimumStepTime
+	if control := universe.control; control != nil {
+		control.mutex.Lock()
+		for control.isPaused && control.steps == 0 && !control.isStopped {
+			control.condition.Wait()
+		}
+		if control.steps > 0 {
+			control.steps--
+		}
+		stepTime = control.stepTime
+		isStopped := control.isStopped
+		control.mutex.Unlock()
+		if isStopped {
+			return false
+		}
+	} else if stepTime < 0 {
+		fmt.Scanln()
+		return true
+	}
+
+	// 指定時間が経過するまで待つ
+	universe.mutex.Lock()
+	sleep := stepTime - int(time.Now().Sub(universe.lastStep).Milliseconds())
+	universe.mutex.Unlock()
+	if sleep > 0 {
+		time.Sleep(time.Duration(sleep) * time.Millisecond)
+	}
+	return true
+}
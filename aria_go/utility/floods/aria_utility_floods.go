@@ -48,3 +48,9 @@ func LoadFloods(settings aria_utility_settings.SettingEntity, floodWidth int, fl
 
 	return floods, total, max
 }
+
+// HasFloods 洪水ファイルがあるか（洪水の予測に使えるステップか）
+func HasFloods(settings aria_utility_settings.SettingEntity, stepCount int) bool {
+	_, err := os.Stat(fmt.Sprintf(settings.FloodFilePath, stepCount))
+	return err == nil
+}
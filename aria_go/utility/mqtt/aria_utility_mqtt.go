@@ -2,37 +2,112 @@ package aria_utility_mqtt
 
 // AttendEntity aria/attend/+のエンティティ(全ての開始前、Universe <- Person)
 type AttendEntity struct {
-	ID    string `json:"id"`
-	Count int    `json:"count"`
+	Header
+	ID        string   `json:"id" schema:"required"`
+	Count     int      `json:"count" schema:"min=0"`
+	Exchange  bool     `json:"exchange"`  // aria/intra/personsの交換フェーズに参加する
+	Active    bool     `json:"active"`    // 実行中のサイクルの状態を持っている（再接続の場合）
+	Session   string   `json:"session"`   // プロセス毎のID（再起動前のプロセスからの通知を区別する）
+	Encodings []string `json:"encodings"` // 受信できるペイロードの形式（省略時はjsonのみ）
 }
 
 // RegisteredEntity aria/registered/+/+のエンティティ(全ての開始前、Universe -> Person)
 type RegisteredEntity struct {
-	ID   string `json:"id"`
-	From int    `json:"from"`
-	To   int    `json:"to"`
+	Header
+	ID       string `json:"id" schema:"required"`
+	From     int    `json:"from" schema:"min=0"`
+	To       int    `json:"to" schema:"min=0"`
+	Encoding string `json:"encoding"` // aria/persons/+で使うペイロードの形式
 }
 
 // TODO : アナウンス方法を変更する
 // CycleEntity aria/cycle/+のエンティティ(サイクルの開始、Universe -> Person)
 type CycleEntity struct {
+	Header
 	AnnounceStep int `json:"a"`
+	Cycle        int `json:"c,omitempty"` // サイクル数（シナリオのサイクルの選択に使う）
 }
 
 // PreparedEntity aria/prepared/+のエンティティ(サイクルの準備完了、Universe <- Person)
 type PreparedEntity struct {
-	ID      string      `json:"id"`
+	Header
+	ID      string      `json:"id" schema:"required"`
 	Persons []AllEntity `json:"persons"`
 }
 
 // StepEntity aria/persons/+のエンティティ(ステップの完了、Universe <- Person)
 type StepEntity struct {
-	ID      string      `json:"id"`
-	Persons []AllEntity `json:"persons"`
+	Header
+	ID       string          `json:"id" schema:"required"`
+	Count    int             `json:"count" schema:"min=0"`
+	Persons  []AllEntity     `json:"persons"`
+	Shelters []ShelterEntity `json:"shelters,omitempty"` // このモジュールのパーソンの避難場所毎の人数
+}
+
+// ExchangeEntity aria/exchange/+のエンティティ(ステップの交換フェーズの開始、Universe -> Person)
+type ExchangeEntity struct {
+	Header
+	Count    int      `json:"count" schema:"min=0"`
+	Modules  []string `json:"modules"`  // 交換フェーズに参加するモジュール
+	Encoding string   `json:"encoding"` // aria/intra/persons/+で使うペイロードの形式
+}
+
+// ExchangedEntity aria/exchanged/+のエンティティ(全てのモジュールの状態の受信完了、Universe <- Person)
+type ExchangedEntity struct {
+	Header
+	ID    string `json:"id" schema:"required"`
+	Count int    `json:"count" schema:"min=0"`
+}
+
+// CheckpointEntity aria/checkpoint/+およびaria/restore/+のエンティティ(状態の保存と再開、Universe -> 全て)
+type CheckpointEntity struct {
+	Header
+	Cycle int    `json:"cycle" schema:"min=0"`
+	Step  int    `json:"step" schema:"min=0"`    // このステップの開始前の状態
+	Path  string `json:"path" schema:"required"` // 状態を保存するディレクトリ
+}
+
+// CheckpointedEntity aria/checkpointed/+のエンティティ(状態の保存完了、Universe <- Person)
+type CheckpointedEntity struct {
+	Header
+	ID   string `json:"id" schema:"required"`
+	Step int    `json:"step" schema:"min=0"`
+}
+
+// HeartbeatEntity aria/heartbeat/+のエンティティ(生存通知、Universe <- Person)
+type HeartbeatEntity struct {
+	Header
+	ID      string `json:"id" schema:"required"`
+	Session string `json:"session"`
+}
+
+// LeaveEntity aria/leave/+のエンティティ(離脱通知、Universe <- Person)
+type LeaveEntity struct {
+	Header
+	ID      string `json:"id" schema:"required"`
+	Session string `json:"session"`
+}
+
+// IntraEntity aria/intra/persons/+のエンティティ(前ステップの状態、Person <-> Person)
+type IntraEntity struct {
+	Header
+	ID      string              `json:"id" schema:"required"`
+	Count   int                 `json:"count" schema:"min=0"`
+	Persons []IntraPersonEntity `json:"persons"`
+}
+
+// IntraPersonEntity aria/intra/persons/+のエンティティ(子)
+type IntraPersonEntity struct {
+	ID        int   `json:"id" schema:"min=0"`
+	NID       int   `json:"nid" schema:"min=0"`
+	Influence int   `json:"influence"`
+	Route     []int `json:"route"`
+	OnLink    bool  `json:"onLink,omitempty"` // NIDからRoute[0]に向かうリンクの途中にいる（リンクの混雑に数える）
 }
 
 // MessageEntity aria/message/+のエンティティ(メッセージ)
 type MessageEntity struct {
+	Header
 	Persons []MessageIDEntity   `json:"persons"`
 	Nodes   []MessageIDEntity   `json:"nodes"`
 	Areas   []MessageAreaEntity `json:"areas"`
@@ -47,18 +122,19 @@ type MessageIDEntity struct {
 type MessageAreaEntity struct {
 	X    float64 `json:"x"`
 	Y    float64 `json:"y"`
-	Size float64 `json:"size"`
+	Size float64 `json:"size" schema:"min=0"`
 }
 
 // CountEntity (1) flood/countのエンティティ(ステップの開始、Universe -> Person)
 type CountEntity struct {
+	Header
 	Count int `json:"count"`
 }
 
 // AllEntity (2) person/send/allのエンティティ
 type AllEntity struct {
 	Count      int     `json:"Simulationtime"`
-	ID         int     `json:"id"`
+	ID         int     `json:"id" schema:"min=0"`
 	X          float64 `json:"X"`
 	Y          float64 `json:"Y"`
 	Status     int     `json:"status"`
@@ -67,22 +143,53 @@ type AllEntity struct {
 
 // RouteEntity (3) person/send/start2target/+のエンティティ
 type RouteEntity struct {
-	StartNID  int `json:"startNID"`
-	TargetNID int `json:"targetNID"`
+	Header
+	StartNID  int     `json:"startNID" schema:"min=0"`
+	TargetNID int     `json:"targetNID"`
+	Speed     float64 `json:"speed,omitempty" schema:"min=0"` // 1ステップの移動距離（到着時の予測水深の計算用）
+	Profile   string  `json:"profile,omitempty"`              // 経路計算のプロファイル（RouteProfileShortestなど、空：設定ファイルのコスト）
 }
 
+// 経路計算のプロファイル（パーソンファイルの15列目、RouteEntityのprofile）
+const (
+	RouteProfileDefault    = ""           // 設定ファイルのRoutingのコスト
+	RouteProfileShortest   = "shortest"   // リンクの長さのみ
+	RouteProfileSafest     = "safest"     // 浸水を強く避ける（FloodWeightの代わりにSafestFloodWeight）
+	RouteProfileDesignated = "designated" // 指定避難場所にのみ向かう
+	RouteProfileMainRoads  = "main_roads" // 主要道路（幅がMainRoadWidth以上のリンク）を優先する
+)
+
 // StatusEntity (4) stat/sendのエンティティ
 type StatusEntity struct {
+	Header
 	AffectedPerson  int     `json:"AffectedPerson"`
 	EvacuatedPerson int     `json:"EvacuatedPerson"`
 	MaxFlood        float64 `json:"MaxFlood"`
 	TotalFlood      float64 `json:"TotalFlood"`
 }
 
-// (5) person/recv/start2target/+は文字の配列
+// (5) person/recv/start2target/+は文字の配列（経路が見つからなかった場合はRouteFailureEntity）
+
+// 経路が見つからなかった理由（RouteFailureEntityのreason）
+const (
+	RouteUnreachable    = "unreachable"     // 受け入れ可能な避難場所に到達できない
+	RouteStartFlooded   = "start_flooded"   // 起点が浸水していて、どこにも進めない
+	RouteUnknownNode    = "unknown_node"    // 起点または目的地が地図にない
+	RouteInvalidRequest = "invalid_request" // 要求を解釈できない
+)
+
+// RouteFailureEntity (5) person/recv/start2target/+のエンティティ(経路が見つからなかった場合、Routing -> Person)
+type RouteFailureEntity struct {
+	Header
+	Reason    string `json:"reason" schema:"required"` // RouteUnreachableなど
+	StartNID  int    `json:"startNID"`
+	TargetNID int    `json:"targetNID"`
+	NID       int    `json:"nid"` // 地図にないノード（unknown_nodeのみ）
+}
 
 // CameraEntity (6) camera/flood/+および(7) camera/antenna/+のエンティティ
 type CameraEntity struct {
+	Header
 	Width  int    `json:"width"`
 	Height int    `json:"height"`
 	Left   int    `json:"lt_x"`
@@ -90,16 +197,80 @@ type CameraEntity struct {
 	Right  int    `json:"rb_x"`
 	Bottom int    `json:"rb_y"`
 	Topic  string `json:"topic"`
-	Data   string `json:"data"`
+	Data   string `json:"data" schema:"required"`
 	X      int    `json:"x"`
 	Y      int    `json:"y"`
 }
 
 // MediaEntity aria/media/+/+のエンティティ(伝達メディア)
 type MediaEntity struct {
+	Header
 	X           float64 `json:"x"`
 	Y           float64 `json:"y"`
-	Size        float64 `json:"size"`
-	Acquisition float64 `json:"acquisition"`
+	Size        float64 `json:"size" schema:"min=0"`
+	Acquisition float64 `json:"acquisition" schema:"min=0,max=1"`
 	Type        string  `json:"type"`
 }
+
+// EventEntity aria/event/+のエンティティ(地図の変更、Universe・外部 -> Routing・Person)
+type EventEntity struct {
+	Header
+	Step   int    `json:"step" schema:"min=0"`    // このステップの開始時に反映する（過ぎている場合は次のステップ）
+	Type   string `json:"type" schema:"required"` // shelter_open、shelter_close、link_close、link_open
+	Target int    `json:"target" schema:"min=0"`  // 避難場所はノードのID、リンクはリンクのID
+}
+
+// SheltersEntity aria/shelters/+のエンティティ(ステップの完了時の避難場所の収容人数、Universe -> 全て)
+type SheltersEntity struct {
+	Header
+	Count    int             `json:"count" schema:"min=0"`
+	Shelters []ShelterEntity `json:"shelters"`
+}
+
+// ShelterEntity aria/shelters/+およびaria/persons/+のエンティティ(子)
+type ShelterEntity struct {
+	NID       int    `json:"nid" schema:"min=0"`       // ノードの避難場所のID
+	Map       string `json:"map,omitempty"`            // ポテンシャルの避難場所の外的要因マップ（FilePath、ノードの避難場所は空）
+	Occupancy int    `json:"occupancy" schema:"min=0"` // 避難完了（7）のパーソンの数
+	Capacity  int    `json:"capacity" schema:"min=0"`  // 収容人数（0：無制限）
+}
+
+// RouteBatchEntity aria/route/request/+/+のエンティティ(モジュールのステップ毎の経路要求をまとめたもの、Person -> Routing)
+type RouteBatchEntity struct {
+	Header
+	Count    int                  `json:"count" schema:"min=0"`
+	Requests []RouteRequestEntity `json:"requests"`
+}
+
+// RouteRequestEntity aria/route/request/+/+のエンティティ(子)
+type RouteRequestEntity struct {
+	ID        int     `json:"id" schema:"min=0"` // パーソンのID
+	StartNID  int     `json:"startNID" schema:"min=0"`
+	TargetNID int     `json:"targetNID"`
+	Speed     float64 `json:"speed,omitempty" schema:"min=0"` // 1ステップの移動距離（到着時の予測水深の計算用）
+	Profile   string  `json:"profile,omitempty"`              // 経路計算のプロファイル
+}
+
+// RouteBatchResultEntity aria/route/response/+/+のエンティティ(要求と同じ順の経路、Routing -> Person)
+type RouteBatchResultEntity struct {
+	Header
+	Count  int                 `json:"count" schema:"min=0"`
+	Routes []RouteResultEntity `json:"routes"`
+}
+
+// RouteResultEntity aria/route/response/+/+のエンティティ(子)
+type RouteResultEntity struct {
+	ID     int    `json:"id" schema:"min=0"` // パーソンのID
+	Route  []int  `json:"route"`             // 経路（起点を含む、見つからなかった場合は空）
+	Reason string `json:"reason,omitempty"`  // 経路が見つからなかった理由（RouteUnreachableなど）
+	NID    int    `json:"nid,omitempty"`     // 地図にないノード（unknown_nodeのみ）
+}
+
+// ErrorEntity aria/error/+のエンティティ(受信したメッセージの解釈や検証のエラー、全て -> 外部)
+type ErrorEntity struct {
+	Header
+	ID      string `json:"id"`      // エラーを検出したモジュール
+	Topic   string `json:"topic"`   // 受信したトピック
+	Error   string `json:"error"`   // エラーの内容
+	Payload string `json:"payload"` // 受信したペイロード（先頭のみ）
+}
@@ -0,0 +1,449 @@
+package aria_utility_mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MQTTのパケット種別
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// パケットの最大サイズ（固定ヘッダーを除く、超えた場合は切断する）
+const (
+	connectPacketSize    = 64 * 1024 // 最初のパケット（CONNECT、認証前なので小さくする）
+	DefaultMaxPacketSize = 64 << 20  // 接続後のパケット（StartBrokerのmaxPacketSizeが0の場合）
+)
+
+// Broker プロセス内のメッセージバスをTCPで公開する組み込みMQTT(3.1.1)ブローカー
+// 同じプロセスでmemory通信を使うモジュールと、外部からMQTTで接続するモジュールは同じトピックを共有する
+type Broker struct {
+	listener      net.Listener
+	bus           *memoryBus
+	maxPacketSize int // 接続後に受け付けるパケットの最大サイズ
+	mutex         sync.Mutex
+	sessions      map[*brokerSession]bool
+	closed        bool
+}
+
+// StartBroker 指定されたアドレス（例 ":1883"）で組み込みブローカーを起動する
+// maxPacketSizeは接続後に受け付けるパケットの最大サイズ（バイト、0：DefaultMaxPacketSize）
+func StartBroker(address string, maxPacketSize int) (*Broker, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if maxPacketSize <= 0 {
+		maxPacketSize = DefaultMaxPacketSize
+	}
+	broker := &Broker{
+		listener:      listener,
+		bus:           defaultBus,
+		maxPacketSize: maxPacketSize,
+		sessions:      make(map[*brokerSession]bool),
+	}
+	go broker.accept()
+	fmt.Printf("[Broker  ] Listening (%s)\n", listener.Addr().String())
+	return broker, nil
+}
+
+// Close ブローカーを停止し、全ての接続を切断する
+func (broker *Broker) Close() {
+	broker.mutex.Lock()
+	broker.closed = true
+	sessions := []*brokerSession{}
+	for session := range broker.sessions {
+		sessions = append(sessions, session)
+	}
+	broker.mutex.Unlock()
+
+	broker.listener.Close()
+	for _, session := range sessions {
+		session.close(false)
+	}
+	fmt.Println("[Broker  ] Closed")
+}
+
+func (broker *Broker) accept() {
+	for {
+		conn, err := broker.listener.Accept()
+		if err != nil {
+			broker.mutex.Lock()
+			closed := broker.closed
+			broker.mutex.Unlock()
+			if closed {
+				return
+			}
+			continue
+		}
+		session := &brokerSession{
+			broker:        broker,
+			conn:          conn,
+			subscriptions: make(map[string]byte),
+		}
+		session.cond = sync.NewCond(&session.mutex)
+		go session.serve()
+	}
+}
+
+// brokerSession 1つのTCP接続
+type brokerSession struct {
+	broker        *Broker
+	conn          net.Conn
+	clientID      string
+	keepAlive     time.Duration
+	will          *memoryMessage
+	mutex         sync.Mutex
+	cond          *sync.Cond
+	subscriptions map[string]byte
+	queue         [][]byte // 送信待ちのパケット
+	closed        bool
+}
+
+// serve 受信したパケットを処理する
+func (session *brokerSession) serve() {
+	reader := bufio.NewReader(session.conn)
+
+	// 最初のパケットはCONNECTでなければならない
+	session.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	packetType, flags, body, err := readPacket(reader, connectPacketSize)
+	if err != nil || packetType != packetConnect {
+		session.conn.Close()
+		return
+	}
+	returnCode := session.connect(flags, body)
+	session.conn.Write([]byte{packetConnack << 4, 2, 0, returnCode})
+	if returnCode != 0 {
+		session.conn.Close()
+		return
+	}
+	session.broker.bus.subscribe(session)
+	go session.write()
+
+	for {
+		if session.keepAlive > 0 {
+			session.conn.SetReadDeadline(time.Now().Add(session.keepAlive * 3 / 2))
+		} else {
+			session.conn.SetReadDeadline(time.Time{})
+		}
+		packetType, flags, body, err := readPacket(reader, session.broker.maxPacketSize)
+		if err != nil {
+			session.close(true)
+			return
+		}
+
+		switch packetType {
+		case packetPublish:
+			qos := (flags >> 1) & 3
+			retained := flags&1 == 1
+			topic, rest, err := readString(body)
+			if err != nil {
+				session.close(true)
+				return
+			}
+			if qos > 0 {
+				if len(rest) < 2 {
+					session.close(true)
+					return
+				}
+				packetID := rest[:2]
+				rest = rest[2:]
+				if qos == 1 {
+					session.send(append([]byte{packetPuback << 4, 2}, packetID...))
+				} else {
+					session.send(append([]byte{packetPubrec << 4, 2}, packetID...))
+				}
+			}
+			session.broker.bus.publish(topic, retained, append([]byte{}, rest...))
+		case packetPubrel:
+			session.send(append([]byte{packetPubcomp << 4, 2}, body...))
+		case packetPuback, packetPubrec, packetPubcomp:
+			// 送信はQoS0のみなので何もしない
+		case packetSubscribe:
+			if len(body) < 2 {
+				session.close(true)
+				return
+			}
+			packetID := body[:2]
+			rest := body[2:]
+			filters := make(map[string]byte)
+			codes := []byte{}
+			for len(rest) > 0 {
+				var filter string
+				filter, rest, err = readString(rest)
+				if err != nil || len(rest) < 1 {
+					session.close(true)
+					return
+				}
+				rest = rest[1:]
+				filters[filter] = 0
+				codes = append(codes, 0) // 全てQoS0で許可する
+			}
+			session.mutex.Lock()
+			for filter := range filters {
+				session.subscriptions[filter] = 0
+			}
+			session.mutex.Unlock()
+			session.send(append(append(appendHeader([]byte{}, packetSuback<<4, 2+len(codes)), packetID...), codes...))
+			for _, message := range session.broker.bus.retainedMessages(filters) {
+				session.deliver(message, true)
+			}
+		case packetUnsubscribe:
+			if len(body) < 2 {
+				session.close(true)
+				return
+			}
+			packetID := body[:2]
+			rest := body[2:]
+			for len(rest) > 0 {
+				var filter string
+				filter, rest, err = readString(rest)
+				if err != nil {
+					session.close(true)
+					return
+				}
+				session.mutex.Lock()
+				delete(session.subscriptions, filter)
+				session.mutex.Unlock()
+			}
+			session.send(append([]byte{packetUnsuback << 4, 2}, packetID...))
+		case packetPingreq:
+			session.send([]byte{packetPingresp << 4, 0})
+		case packetDisconnect:
+			session.close(false)
+			return
+		default:
+			session.close(true)
+			return
+		}
+	}
+}
+
+// connect CONNECTパケットを解釈して戻り値コードを返す
+func (session *brokerSession) connect(flags byte, body []byte) byte {
+	protocol, rest, err := readString(body)
+	if err != nil || len(rest) < 4 {
+		return 2
+	}
+	level := rest[0]
+	if !(protocol == "MQTT" && level == 4) && !(protocol == "MQIsdp" && level == 3) {
+		return 1
+	}
+	connectFlags := rest[1]
+	session.keepAlive = time.Duration(binary.BigEndian.Uint16(rest[2:4])) * time.Second
+	rest = rest[4:]
+
+	session.clientID, rest, err = readString(rest)
+	if err != nil {
+		return 2
+	}
+	if connectFlags&0x04 != 0 {
+		var topic string
+		var payload []byte
+		if topic, rest, err = readString(rest); err != nil {
+			return 2
+		}
+		if payload, rest, err = readBytes(rest); err != nil {
+			return 2
+		}
+		session.will = &memoryMessage{topic: topic, payload: payload, retained: connectFlags&0x20 != 0}
+	}
+	// ユーザー名とパスワードは受け付けるが検証しない
+	session.broker.register(session)
+	return 0
+}
+
+// register 接続を登録する
+// 同じクライアントIDの接続が残っている場合は切断する（MQTT-3.1.4-2、再接続したモジュールのWillメッセージは配送しない）
+func (broker *Broker) register(session *brokerSession) {
+	broker.mutex.Lock()
+	stales := []*brokerSession{}
+	for other := range broker.sessions {
+		if session.clientID != "" && other.clientID == session.clientID {
+			stales = append(stales, other)
+		}
+	}
+	broker.sessions[session] = true
+	broker.mutex.Unlock()
+
+	for _, stale := range stales {
+		stale.close(false)
+	}
+}
+
+// deliver 購読しているトピックであればPUBLISHパケットを送信待ちに追加する
+func (session *brokerSession) deliver(message *memoryMessage, force bool) {
+	if !force {
+		session.mutex.Lock()
+		matched := false
+		for filter := range session.subscriptions {
+			if MatchTopic(filter, message.topic) {
+				matched = true
+				break
+			}
+		}
+		session.mutex.Unlock()
+		if !matched {
+			return
+		}
+	}
+
+	var flags byte
+	if message.retained {
+		flags = 1
+	}
+	body := appendString([]byte{}, message.topic)
+	body = append(body, message.payload...)
+	session.send(append(appendHeader([]byte{}, packetPublish<<4|flags, len(body)), body...))
+}
+
+// send パケットを送信待ちに追加する
+func (session *brokerSession) send(packet []byte) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.closed {
+		return
+	}
+	session.queue = append(session.queue, packet)
+	session.cond.Signal()
+}
+
+// write 送信待ちのパケットを順番に送信する
+func (session *brokerSession) write() {
+	writer := bufio.NewWriter(session.conn)
+	for {
+		session.mutex.Lock()
+		for !session.closed && len(session.queue) == 0 {
+			session.cond.Wait()
+		}
+		if session.closed {
+			session.mutex.Unlock()
+			return
+		}
+		packets := session.queue
+		session.queue = nil
+		session.mutex.Unlock()
+
+		for _, packet := range packets {
+			writer.Write(packet)
+		}
+		if err := writer.Flush(); err != nil {
+			session.close(true)
+			return
+		}
+	}
+}
+
+// close 接続を閉じる（異常切断の場合はWillメッセージを配送する）
+func (session *brokerSession) close(abnormal bool) {
+	session.mutex.Lock()
+	if session.closed {
+		session.mutex.Unlock()
+		return
+	}
+	session.closed = true
+	session.cond.Broadcast()
+	session.mutex.Unlock()
+
+	session.broker.bus.unsubscribe(session)
+	session.broker.mutex.Lock()
+	delete(session.broker.sessions, session)
+	session.broker.mutex.Unlock()
+	session.conn.Close()
+
+	if abnormal && session.will != nil {
+		session.broker.bus.publish(session.will.topic, session.will.retained, session.will.payload)
+	}
+}
+
+// readPacket 固定ヘッダーを読み、パケット種別とフラグと残りのデータを返す（残りのデータがlimitを超える場合はエラー）
+func readPacket(reader *bufio.Reader, limit int) (byte, byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errors.New("malformed remaining length")
+		}
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(digit&127) * multiplier
+		multiplier *= 128
+		if digit&128 == 0 {
+			break
+		}
+	}
+	if length > limit {
+		return 0, 0, nil, fmt.Errorf("packet too large (%d bytes, limit %d)", length, limit)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
+
+// readBytes 長さ（2バイト）付きのデータを読む
+func readBytes(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("malformed packet")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return nil, nil, errors.New("malformed packet")
+	}
+	return data[2 : 2+length], data[2+length:], nil
+}
+
+// readString 長さ（2バイト）付きの文字列を読む
+func readString(data []byte) (string, []byte, error) {
+	value, rest, err := readBytes(data)
+	return string(value), rest, err
+}
+
+// appendString 長さ（2バイト）付きの文字列を追加する
+func appendString(data []byte, value string) []byte {
+	data = append(data, byte(len(value)>>8), byte(len(value)))
+	return append(data, value...)
+}
+
+// appendHeader 固定ヘッダーを追加する
+func appendHeader(data []byte, header byte, length int) []byte {
+	data = append(data, header)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 128
+		}
+		data = append(data, digit)
+		if length == 0 {
+			return data
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package aria_utility_mqtt
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// startTestBroker 空いているポートでブローカーを起動する
+func startTestBroker(t *testing.T) (*Broker, string) {
+	return startTestBrokerWithLimit(t, 0)
+}
+
+// startTestBrokerWithLimit パケットの最大サイズを指定してブローカーを起動する
+func startTestBrokerWithLimit(t *testing.T, maxPacketSize int) (*Broker, string) {
+	broker, err := StartBroker("127.0.0.1:0", maxPacketSize)
+	if err != nil {
+		t.Fatalf("StartBroker: %v", err)
+	}
+	t.Cleanup(broker.Close)
+	return broker, "tcp://" + broker.listener.Addr().String()
+}
+
+// connectTestClient paho（またはmemory）のクライアントで接続する
+func connectTestClient(t *testing.T, transport string, address string, id string, configure func(*MQTT.ClientOptions)) MQTT.Client {
+	opts := MQTT.NewClientOptions().AddBroker(address).SetClientID(id).SetAutoReconnect(false)
+	if configure != nil {
+		configure(opts)
+	}
+	client := NewClient(transport, opts)
+	if token := client.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("%s: Connect: %v", id, token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client
+}
+
+// subscribeTestClient 受信したメッセージをチャネルに送る購読
+func subscribeTestClient(t *testing.T, client MQTT.Client, filter string) <-chan MQTT.Message {
+	messages := make(chan MQTT.Message, 16)
+	token := client.Subscribe(filter, 0, func(client MQTT.Client, message MQTT.Message) {
+		messages <- message
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Subscribe(%s): %v", filter, token.Error())
+	}
+	return messages
+}
+
+func receiveTestMessage(t *testing.T, messages <-chan MQTT.Message, topic string, payload string, retained bool) {
+	select {
+	case message := <-messages:
+		if message.Topic() != topic || string(message.Payload()) != payload || message.Retained() != retained {
+			t.Fatalf("received %s %q (retained %v), want %s %q (retained %v)", message.Topic(), message.Payload(), message.Retained(), topic, payload, retained)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message on %s", topic)
+	}
+}
+
+func TestBrokerPublishSubscribe(t *testing.T) {
+	_, address := startTestBroker(t)
+	subscriber := connectTestClient(t, TransportMQTT, address, "subscriber", nil)
+	publisher := connectTestClient(t, TransportMQTT, address, "publisher", nil)
+	local := connectTestClient(t, TransportMemory, address, "local", nil)
+	remoteMessages := subscribeTestClient(t, subscriber, "broker_test/pubsub/+")
+	localMessages := subscribeTestClient(t, local, "broker_test/pubsub/#")
+
+	for qos := byte(0); qos <= 2; qos++ {
+		if token := publisher.Publish("broker_test/pubsub/remote", qos, false, "hello"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+			t.Fatalf("Publish(qos %d): %v", qos, token.Error())
+		}
+		receiveTestMessage(t, remoteMessages, "broker_test/pubsub/remote", "hello", false)
+		receiveTestMessage(t, localMessages, "broker_test/pubsub/remote", "hello", false)
+	}
+
+	// memory通信のモジュールからMQTTのモジュールへ
+	local.Publish("broker_test/pubsub/local", 0, false, "from memory").Wait()
+	receiveTestMessage(t, remoteMessages, "broker_test/pubsub/local", "from memory", false)
+	receiveTestMessage(t, localMessages, "broker_test/pubsub/local", "from memory", false)
+
+	// 購読していないトピックは届かない
+	publisher.Publish("broker_test/other", 0, false, "ignored").Wait()
+	subscriber.Unsubscribe("broker_test/pubsub/+").Wait()
+	publisher.Publish("broker_test/pubsub/remote", 0, false, "unsubscribed").Wait()
+	receiveTestMessage(t, localMessages, "broker_test/pubsub/remote", "unsubscribed", false)
+	select {
+	case message := <-remoteMessages:
+		t.Fatalf("received %s %q after unsubscribing", message.Topic(), message.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBrokerRetained(t *testing.T) {
+	_, address := startTestBroker(t)
+	publisher := connectTestClient(t, TransportMQTT, address, "publisher", nil)
+	publisher.Publish("broker_test/retained", 1, true, "state").Wait()
+
+	subscriber := connectTestClient(t, TransportMQTT, address, "subscriber", nil)
+	receiveTestMessage(t, subscribeTestClient(t, subscriber, "broker_test/#"), "broker_test/retained", "state", true)
+}
+
+func TestBrokerWill(t *testing.T) {
+	broker, address := startTestBroker(t)
+	subscriber := connectTestClient(t, TransportMQTT, address, "subscriber", nil)
+	messages := subscribeTestClient(t, subscriber, "broker_test/will/+")
+
+	connectTestClient(t, TransportMQTT, address, "graceful", func(opts *MQTT.ClientOptions) {
+		opts.SetWill("broker_test/will/graceful", "gone", 0, false)
+	}).Disconnect(250)
+	connectTestClient(t, TransportMQTT, address, "dropped", func(opts *MQTT.ClientOptions) {
+		opts.SetWill("broker_test/will/dropped", "gone", 0, false)
+	})
+
+	// 接続が切れた（DISCONNECTなし）場合のみWillメッセージを配送する
+	broker.mutex.Lock()
+	for session := range broker.sessions {
+		if session.clientID == "dropped" {
+			session.conn.Close()
+		}
+	}
+	broker.mutex.Unlock()
+	receiveTestMessage(t, messages, "broker_test/will/dropped", "gone", false)
+	select {
+	case message := <-messages:
+		t.Fatalf("received %s %q", message.Topic(), message.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// 同じクライアントIDで接続した場合は前の接続を切断する（Willメッセージは配送しない）
+func TestBrokerTakeOver(t *testing.T) {
+	broker, address := startTestBroker(t)
+	subscriber := connectTestClient(t, TransportMQTT, address, "subscriber", nil)
+	messages := subscribeTestClient(t, subscriber, "broker_test/takeover/+")
+
+	lost := make(chan error, 1)
+	connectTestClient(t, TransportMQTT, address, "module", func(opts *MQTT.ClientOptions) {
+		opts.SetWill("broker_test/takeover/will", "gone", 0, false)
+		opts.SetConnectionLostHandler(func(client MQTT.Client, err error) { lost <- err })
+	})
+	reconnected := connectTestClient(t, TransportMQTT, address, "module", func(opts *MQTT.ClientOptions) {
+		opts.SetWill("broker_test/takeover/will", "gone", 0, false)
+	})
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the old connection was not dropped")
+	}
+
+	broker.mutex.Lock()
+	count := 0
+	for session := range broker.sessions {
+		if session.clientID == "module" {
+			count++
+		}
+	}
+	broker.mutex.Unlock()
+	if count != 1 {
+		t.Fatalf("%d sessions with the same client ID, want 1", count)
+	}
+
+	reconnected.Publish("broker_test/takeover/alive", 0, false, "alive").Wait()
+	receiveTestMessage(t, messages, "broker_test/takeover/alive", "alive", false)
+	select {
+	case message := <-messages:
+		t.Fatalf("received %s %q", message.Topic(), message.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// 最大サイズを超えるパケットを送った接続は、本体を受信する前に切断する
+func TestBrokerPacketSize(t *testing.T) {
+	broker, address := startTestBrokerWithLimit(t, 1024)
+
+	// CONNECTの前に残りの長さだけで大きなパケットを予告する
+	conn, err := net.Dial("tcp", broker.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(appendHeader([]byte{}, packetConnect<<4, 200<<20))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+		t.Fatalf("Read after an oversize CONNECT = %d, %v, want the connection closed", n, err)
+	}
+
+	subscriber := connectTestClient(t, TransportMQTT, address, "subscriber", nil)
+	messages := subscribeTestClient(t, subscriber, "broker_test/size/+")
+	lost := make(chan error, 1)
+	publisher := connectTestClient(t, TransportMQTT, address, "publisher", func(opts *MQTT.ClientOptions) {
+		opts.SetConnectionLostHandler(func(client MQTT.Client, err error) { lost <- err })
+	})
+	publisher.Publish("broker_test/size/small", 0, false, "small").Wait()
+	receiveTestMessage(t, messages, "broker_test/size/small", "small", false)
+
+	publisher.Publish("broker_test/size/large", 0, false, strings.Repeat("x", 2048)).Wait()
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection that sent an oversize PUBLISH was not dropped")
+	}
+	select {
+	case message := <-messages:
+		t.Fatalf("received %s (%d bytes)", message.Topic(), len(message.Payload()))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func isTimeout(err error) bool {
+	timeout, ok := err.(net.Error)
+	return ok && timeout.Timeout()
+}
@@ -0,0 +1,51 @@
+package aria_utility_mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CheckpointRouting Routingモジュールの状態のファイル名（全てのRoutingモジュールが同じ状態を持つ）
+const CheckpointRouting = "routing"
+
+// CheckpointDirectory サイクルとステップ毎のチェックポイントのディレクトリ
+func CheckpointDirectory(root string, cycle int, step int) string {
+	return filepath.Join(root, fmt.Sprintf("cycle%03d_step%05d", cycle, step))
+}
+
+// SaveCheckpoint モジュールの状態を<directory>/<name>.jsonに保存する（途中で異常終了しても前の状態は壊さない）
+func SaveCheckpoint(directory string, name string, state interface{}) error {
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(directory, 0777); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(directory, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(bytes); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(directory, name+".json"))
+}
+
+// LoadCheckpoint <directory>/<name>.jsonからモジュールの状態を読み込む
+func LoadCheckpoint(directory string, name string, state interface{}) error {
+	bytes, err := ioutil.ReadFile(filepath.Join(directory, name+".json"))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, state)
+}
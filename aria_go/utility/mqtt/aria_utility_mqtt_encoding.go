@@ -0,0 +1,317 @@
+package aria_utility_mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// モジュール間のペイロードの形式
+const (
+	EncodingJSON   = "json"   // JSON（既定、外部のツール向け）
+	EncodingBinary = "binary" // 固定レイアウトの列指向バイナリ
+)
+
+// Encodings このモジュールが受信できる形式の一覧（aria/attendで通知する）
+var Encodings = []string{EncodingJSON, EncodingBinary}
+
+// バイナリ形式のフレーム
+// [0]マジック [1]種別 [2]バージョン [3:]本体（リトルエンディアン）
+// JSONは必ず'{'で始まるので、先頭のバイトで形式を判別する
+const (
+	frameMagic   = 0xA5
+	frameStep    = 1
+	frameIntra   = 2
+	frameVersion = 1
+)
+
+var errMalformedFrame = errors.New("malformed frame")
+
+// SupportsEncoding 形式の一覧に指定された形式が含まれているか調べる
+func SupportsEncoding(encodings []string, encoding string) bool {
+	for _, value := range encodings {
+		if value == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodeStep aria/persons/+のペイロードを生成する
+// 本体：ID、Count、人数n、ID[n]、X[n]、Y[n]、Status[n]、InfoAccess[n]、
+// 避難場所の数m、NID[m]、Map[m]、Occupancy[m]、Capacity[m]（避難場所は末尾にあり、古いモジュールは読み飛ばす）
+func EncodeStep(encoding string, entity StepEntity) []byte {
+	if encoding != EncodingBinary {
+		return Encode(&entity)
+	}
+
+	n := len(entity.Persons)
+	writer := newFrameWriter(frameStep, len(entity.ID)+n*28+len(entity.Shelters)*16+20)
+	writer.putString(entity.ID)
+	writer.putInt(entity.Count)
+	writer.putInt(n)
+	for _, person := range entity.Persons {
+		writer.putInt(person.ID)
+	}
+	for _, person := range entity.Persons {
+		writer.putFloat(person.X)
+	}
+	for _, person := range entity.Persons {
+		writer.putFloat(person.Y)
+	}
+	for _, person := range entity.Persons {
+		writer.putInt(person.Status)
+	}
+	for _, person := range entity.Persons {
+		writer.putInt(person.InfoAccess)
+	}
+	writer.putInt(len(entity.Shelters))
+	for _, shelter := range entity.Shelters {
+		writer.putInt(shelter.NID)
+	}
+	for _, shelter := range entity.Shelters {
+		writer.putString(shelter.Map)
+	}
+	for _, shelter := range entity.Shelters {
+		writer.putInt(shelter.Occupancy)
+	}
+	for _, shelter := range entity.Shelters {
+		writer.putInt(shelter.Capacity)
+	}
+	return writer.data
+}
+
+// DecodeStep aria/persons/+のペイロードを解釈する（JSONとバイナリのどちらでもよい）
+func DecodeStep(payload []byte) (StepEntity, error) {
+	var entity StepEntity
+	if !isFrame(payload) {
+		err := Decode(payload, &entity)
+		return entity, err
+	}
+
+	reader, err := newFrameReader(payload, frameStep)
+	if err != nil {
+		return entity, err
+	}
+	entity.ID = reader.readString()
+	entity.Count = reader.readInt()
+	n := reader.readCount(28)
+	entity.Persons = make([]AllEntity, n)
+	for i := range entity.Persons {
+		entity.Persons[i].Count = entity.Count
+		entity.Persons[i].ID = reader.readInt()
+	}
+	for i := range entity.Persons {
+		entity.Persons[i].X = reader.readFloat()
+	}
+	for i := range entity.Persons {
+		entity.Persons[i].Y = reader.readFloat()
+	}
+	for i := range entity.Persons {
+		entity.Persons[i].Status = reader.readInt()
+	}
+	for i := range entity.Persons {
+		entity.Persons[i].InfoAccess = reader.readInt()
+	}
+
+	// 避難場所のない古いモジュールのフレーム
+	if reader.err == nil && len(reader.data) == 0 {
+		entity.Version = SchemaVersion
+		return entity, Validate(&entity)
+	}
+	m := reader.readCount(16)
+	entity.Shelters = make([]ShelterEntity, m)
+	for i := range entity.Shelters {
+		entity.Shelters[i].NID = reader.readInt()
+	}
+	for i := range entity.Shelters {
+		entity.Shelters[i].Map = reader.readString()
+	}
+	for i := range entity.Shelters {
+		entity.Shelters[i].Occupancy = reader.readInt()
+	}
+	for i := range entity.Shelters {
+		entity.Shelters[i].Capacity = reader.readInt()
+	}
+	if reader.err != nil {
+		return entity, reader.err
+	}
+	entity.Version = SchemaVersion
+	return entity, Validate(&entity)
+}
+
+// EncodeIntra aria/intra/persons/+のペイロードを生成する
+// 本体：ID、Count、人数n、ID[n]、NID[n]、Influence[n]、経路の長さ[n]、経路（全員分を連結）、
+// OnLink[n]（1：リンクの途中、末尾にあり、古いモジュールは読み飛ばす）
+func EncodeIntra(encoding string, entity IntraEntity) []byte {
+	if encoding != EncodingBinary {
+		return Encode(&entity)
+	}
+
+	n := len(entity.Persons)
+	total := 0
+	for _, person := range entity.Persons {
+		total += len(person.Route)
+	}
+	writer := newFrameWriter(frameIntra, len(entity.ID)+n*20+total*4+16)
+	writer.putString(entity.ID)
+	writer.putInt(entity.Count)
+	writer.putInt(n)
+	for _, person := range entity.Persons {
+		writer.putInt(person.ID)
+	}
+	for _, person := range entity.Persons {
+		writer.putInt(person.NID)
+	}
+	for _, person := range entity.Persons {
+		writer.putInt(person.Influence)
+	}
+	for _, person := range entity.Persons {
+		writer.putInt(len(person.Route))
+	}
+	for _, person := range entity.Persons {
+		for _, nid := range person.Route {
+			writer.putInt(nid)
+		}
+	}
+	for _, person := range entity.Persons {
+		onLink := 0
+		if person.OnLink {
+			onLink = 1
+		}
+		writer.putInt(onLink)
+	}
+	return writer.data
+}
+
+// DecodeIntra aria/intra/persons/+のペイロードを解釈する（JSONとバイナリのどちらでもよい）
+func DecodeIntra(payload []byte) (IntraEntity, error) {
+	var entity IntraEntity
+	if !isFrame(payload) {
+		err := Decode(payload, &entity)
+		return entity, err
+	}
+
+	reader, err := newFrameReader(payload, frameIntra)
+	if err != nil {
+		return entity, err
+	}
+	entity.ID = reader.readString()
+	entity.Count = reader.readInt()
+	n := reader.readCount(16)
+	entity.Persons = make([]IntraPersonEntity, n)
+	for i := range entity.Persons {
+		entity.Persons[i].ID = reader.readInt()
+	}
+	for i := range entity.Persons {
+		entity.Persons[i].NID = reader.readInt()
+	}
+	for i := range entity.Persons {
+		entity.Persons[i].Influence = reader.readInt()
+	}
+	lengths := make([]int, n)
+	for i := range lengths {
+		lengths[i] = reader.readCount(4)
+	}
+	for i := range entity.Persons {
+		entity.Persons[i].Route = make([]int, lengths[i])
+		for j := range entity.Persons[i].Route {
+			entity.Persons[i].Route[j] = reader.readInt()
+		}
+	}
+
+	// リンクの途中かどうか（古いモジュールのフレームにはない）
+	if reader.err == nil && len(reader.data) > 0 {
+		for i := range entity.Persons {
+			entity.Persons[i].OnLink = reader.readInt() == 1
+		}
+	}
+	if reader.err != nil {
+		return entity, reader.err
+	}
+	entity.Version = SchemaVersion
+	return entity, Validate(&entity)
+}
+
+func isFrame(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == frameMagic
+}
+
+// frameWriter バイナリ形式のフレームを書き込む
+type frameWriter struct {
+	data []byte
+}
+
+func newFrameWriter(frameType byte, capacity int) *frameWriter {
+	writer := &frameWriter{data: make([]byte, 0, capacity)}
+	writer.data = append(writer.data, frameMagic, frameType, frameVersion)
+	return writer
+}
+
+func (writer *frameWriter) putInt(value int) {
+	var buffer [4]byte
+	binary.LittleEndian.PutUint32(buffer[:], uint32(int32(value)))
+	writer.data = append(writer.data, buffer[:]...)
+}
+
+func (writer *frameWriter) putFloat(value float64) {
+	var buffer [8]byte
+	binary.LittleEndian.PutUint64(buffer[:], math.Float64bits(value))
+	writer.data = append(writer.data, buffer[:]...)
+}
+
+func (writer *frameWriter) putString(value string) {
+	writer.putInt(len(value))
+	writer.data = append(writer.data, value...)
+}
+
+// frameReader バイナリ形式のフレームを読み込む（途中で足りなくなった場合はerrを設定し、以降は0を返す）
+type frameReader struct {
+	data []byte
+	err  error
+}
+
+func newFrameReader(payload []byte, frameType byte) (*frameReader, error) {
+	if len(payload) < 3 || payload[1] != frameType || payload[2] != frameVersion {
+		return nil, errMalformedFrame
+	}
+	return &frameReader{data: payload[3:]}, nil
+}
+
+func (reader *frameReader) readBytes(size int) []byte {
+	if reader.err != nil || len(reader.data) < size {
+		reader.err = errMalformedFrame
+		return nil
+	}
+	value := reader.data[:size]
+	reader.data = reader.data[size:]
+	return value
+}
+
+func (reader *frameReader) readInt() int {
+	if value := reader.readBytes(4); value != nil {
+		return int(int32(binary.LittleEndian.Uint32(value)))
+	}
+	return 0
+}
+
+func (reader *frameReader) readFloat() float64 {
+	if value := reader.readBytes(8); value != nil {
+		return math.Float64frombits(binary.LittleEndian.Uint64(value))
+	}
+	return 0
+}
+
+func (reader *frameReader) readString() string {
+	return string(reader.readBytes(reader.readCount(1)))
+}
+
+// readCount 要素数を読む（残りのデータに収まらない要素数の場合はエラー）
+func (reader *frameReader) readCount(size int) int {
+	value := reader.readInt()
+	if value < 0 || value*size > len(reader.data) {
+		reader.err = errMalformedFrame
+		return 0
+	}
+	return value
+}
@@ -0,0 +1,174 @@
+package aria_utility_mqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+var stepTests = []struct {
+	name   string
+	entity StepEntity
+}{
+	{"empty", StepEntity{ID: "p"}},
+	{"persons", StepEntity{ID: "person-1", Count: 12, Persons: []AllEntity{
+		{Count: 12, ID: 0, X: 1.5, Y: -2.25, Status: 1, InfoAccess: 0},
+		{Count: 12, ID: 7, X: 10951, Y: 10151, Status: 7, InfoAccess: 1},
+	}}},
+	{"shelters", StepEntity{ID: "person-2", Count: 3, Persons: []AllEntity{
+		{Count: 3, ID: 4, X: 0.125, Y: 3, Status: 7},
+	}, Shelters: []ShelterEntity{
+		{NID: 10, Occupancy: 1, Capacity: 100},
+		{NID: 11, Map: "./potential/shelter.csv", Occupancy: 0, Capacity: 0},
+	}}},
+}
+
+var intraTests = []struct {
+	name   string
+	entity IntraEntity
+}{
+	{"empty", IntraEntity{ID: "p"}},
+	{"routes", IntraEntity{ID: "person-1", Count: 5, Persons: []IntraPersonEntity{
+		{ID: 0, NID: 3, Influence: 10, Route: []int{4, 5, 6}},
+		{ID: 1, NID: 8, Influence: -1},
+		{ID: 2, NID: 9, Influence: 2, Route: []int{1}, OnLink: true},
+	}}},
+}
+
+func TestStepRoundTrip(t *testing.T) {
+	for _, test := range stepTests {
+		for _, encoding := range Encodings {
+			t.Run(test.name+"/"+encoding, func(t *testing.T) {
+				decoded, err := DecodeStep(EncodeStep(encoding, test.entity))
+				if err != nil {
+					t.Fatalf("DecodeStep: %v", err)
+				}
+				want := test.entity
+				want.Version = SchemaVersion
+				if !reflect.DeepEqual(normalizeStep(decoded), normalizeStep(want)) {
+					t.Fatalf("DecodeStep = %+v, want %+v", decoded, want)
+				}
+			})
+		}
+	}
+}
+
+func TestIntraRoundTrip(t *testing.T) {
+	for _, test := range intraTests {
+		for _, encoding := range Encodings {
+			t.Run(test.name+"/"+encoding, func(t *testing.T) {
+				decoded, err := DecodeIntra(EncodeIntra(encoding, test.entity))
+				if err != nil {
+					t.Fatalf("DecodeIntra: %v", err)
+				}
+				want := test.entity
+				want.Version = SchemaVersion
+				if !reflect.DeepEqual(normalizeIntra(decoded), normalizeIntra(want)) {
+					t.Fatalf("DecodeIntra = %+v, want %+v", decoded, want)
+				}
+			})
+		}
+	}
+}
+
+// 避難場所のない古いモジュールのフレーム
+func TestDecodeStepWithoutShelters(t *testing.T) {
+	entity := stepTests[1].entity
+	decoded, err := DecodeStep(oldStepFrame(entity))
+	if err != nil {
+		t.Fatalf("DecodeStep: %v", err)
+	}
+	entity.Version = SchemaVersion
+	if !reflect.DeepEqual(normalizeStep(decoded), normalizeStep(entity)) {
+		t.Fatalf("DecodeStep = %+v, want %+v", decoded, entity)
+	}
+}
+
+// OnLinkのない古いモジュールのフレーム
+func TestDecodeIntraWithoutOnLink(t *testing.T) {
+	entity := intraTests[1].entity
+	decoded, err := DecodeIntra(oldIntraFrame(entity))
+	if err != nil {
+		t.Fatalf("DecodeIntra: %v", err)
+	}
+	for i := range entity.Persons {
+		if decoded.Persons[i].OnLink {
+			t.Fatalf("person %d: OnLink = true in a frame without OnLink", i)
+		}
+		decoded.Persons[i].OnLink = entity.Persons[i].OnLink
+	}
+	entity.Version = SchemaVersion
+	if !reflect.DeepEqual(normalizeIntra(decoded), normalizeIntra(entity)) {
+		t.Fatalf("DecodeIntra = %+v, want %+v", decoded, entity)
+	}
+}
+
+// 途中で切れたフレームはエラー（古いモジュールのフレームと同じ長さの場合を除く）
+func TestDecodeTruncatedFrame(t *testing.T) {
+	step := stepTests[2].entity
+	stepFrame := EncodeStep(EncodingBinary, step)
+	oldStep := len(oldStepFrame(step))
+	for size := 0; size < len(stepFrame); size++ {
+		if _, err := DecodeStep(stepFrame[:size]); (err == nil) != (size == oldStep) {
+			t.Errorf("DecodeStep(%d of %d bytes) error = %v", size, len(stepFrame), err)
+		}
+	}
+
+	intra := intraTests[1].entity
+	intraFrame := EncodeIntra(EncodingBinary, intra)
+	oldIntra := len(oldIntraFrame(intra))
+	for size := 0; size < len(intraFrame); size++ {
+		if _, err := DecodeIntra(intraFrame[:size]); (err == nil) != (size == oldIntra) {
+			t.Errorf("DecodeIntra(%d of %d bytes) error = %v", size, len(intraFrame), err)
+		}
+	}
+}
+
+func TestDecodeWrongFrame(t *testing.T) {
+	if _, err := DecodeStep(EncodeIntra(EncodingBinary, intraTests[1].entity)); err != errMalformedFrame {
+		t.Errorf("DecodeStep(intra frame) error = %v", err)
+	}
+	frame := EncodeStep(EncodingBinary, stepTests[1].entity)
+	frame[2] = frameVersion + 1
+	if _, err := DecodeStep(frame); err != errMalformedFrame {
+		t.Errorf("DecodeStep(frame version %d) error = %v", frame[2], err)
+	}
+}
+
+// oldStepFrame 避難場所を書き込む前のEncodeStepと同じフレーム
+func oldStepFrame(entity StepEntity) []byte {
+	frame := EncodeStep(EncodingBinary, StepEntity{ID: entity.ID, Count: entity.Count, Persons: entity.Persons})
+	return frame[:len(frame)-4]
+}
+
+// oldIntraFrame OnLinkを書き込む前のEncodeIntraと同じフレーム
+func oldIntraFrame(entity IntraEntity) []byte {
+	frame := EncodeIntra(EncodingBinary, entity)
+	return frame[:len(frame)-4*len(entity.Persons)]
+}
+
+// normalizeStep 空の配列とnilを区別しない
+func normalizeStep(entity StepEntity) StepEntity {
+	if len(entity.Persons) == 0 {
+		entity.Persons = nil
+	}
+	if len(entity.Shelters) == 0 {
+		entity.Shelters = nil
+	}
+	return entity
+}
+
+// normalizeIntra 空の配列とnilを区別しない
+func normalizeIntra(entity IntraEntity) IntraEntity {
+	persons := make([]IntraPersonEntity, len(entity.Persons))
+	for i, person := range entity.Persons {
+		if len(person.Route) == 0 {
+			person.Route = nil
+		}
+		persons[i] = person
+	}
+	entity.Persons = persons
+	if len(entity.Persons) == 0 {
+		entity.Persons = nil
+	}
+	return entity
+}
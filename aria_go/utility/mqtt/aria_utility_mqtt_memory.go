@@ -0,0 +1,325 @@
+package aria_utility_mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// 通信方式
+const (
+	TransportMQTT   = "mqtt"   // MQTTブローカー経由（既定）
+	TransportMemory = "memory" // プロセス内のメッセージバス（ブローカー不要）
+)
+
+// NewClient 設定された通信方式に応じたクライアントを生成する
+func NewClient(transport string, opts *MQTT.ClientOptions) MQTT.Client {
+	switch transport {
+	case "", TransportMQTT:
+		return MQTT.NewClient(opts)
+	case TransportMemory:
+		return defaultBus.newClient(opts)
+	}
+	panic(fmt.Sprintf("unknown transport : %s", transport))
+}
+
+// MatchTopic トピックフィルタ（+ と # を含む）にトピックが一致するか調べる
+func MatchTopic(filter string, topic string) bool {
+	filters := strings.Split(filter, "/")
+	topics := strings.Split(topic, "/")
+	for i, level := range filters {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topics) {
+			return false
+		}
+		if level != "+" && level != topics[i] {
+			return false
+		}
+	}
+	return len(filters) == len(topics)
+}
+
+// memorySubscriber メッセージバスからメッセージを受け取る購読者（クライアント、ブローカーのセッション）
+type memorySubscriber interface {
+	deliver(message *memoryMessage, force bool)
+}
+
+// memoryBus プロセス内のメッセージバス
+type memoryBus struct {
+	mutex    sync.RWMutex
+	clients  map[memorySubscriber]bool
+	retained map[string][]byte
+}
+
+var defaultBus = &memoryBus{
+	clients:  make(map[memorySubscriber]bool),
+	retained: make(map[string][]byte),
+}
+
+func (bus *memoryBus) newClient(opts *MQTT.ClientOptions) *memoryClient {
+	client := &memoryClient{
+		bus:     bus,
+		options: opts,
+		routes:  make(map[string]MQTT.MessageHandler),
+	}
+	client.cond = sync.NewCond(&client.mutex)
+	return client
+}
+
+// publish 購読している全ての購読者にメッセージを配送する
+func (bus *memoryBus) publish(topic string, retained bool, payload []byte) {
+	bus.mutex.Lock()
+	if retained {
+		if len(payload) == 0 {
+			delete(bus.retained, topic)
+		} else {
+			bus.retained[topic] = payload
+		}
+	}
+
+	// 配送が終わるまでロックしておく（別のPublishが先に届いて順序が入れ替わらないようにする）
+	for client := range bus.clients {
+		client.deliver(&memoryMessage{topic: topic, payload: payload}, false)
+	}
+	bus.mutex.Unlock()
+}
+
+// subscribe 購読者を追加する
+func (bus *memoryBus) subscribe(client memorySubscriber) {
+	bus.mutex.Lock()
+	bus.clients[client] = true
+	bus.mutex.Unlock()
+}
+
+// unsubscribe 購読者を削除する
+func (bus *memoryBus) unsubscribe(client memorySubscriber) {
+	bus.mutex.Lock()
+	delete(bus.clients, client)
+	bus.mutex.Unlock()
+}
+
+// retainedMessages トピックフィルタに一致する保持されたメッセージを取得する
+func (bus *memoryBus) retainedMessages(filters map[string]byte) []*memoryMessage {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+	messages := []*memoryMessage{}
+	for topic, payload := range bus.retained {
+		for filter := range filters {
+			if MatchTopic(filter, topic) {
+				messages = append(messages, &memoryMessage{topic: topic, payload: payload, retained: true})
+				break
+			}
+		}
+	}
+	return messages
+}
+
+// memoryClient MQTT.Clientを満たすプロセス内のクライアント
+type memoryClient struct {
+	bus       *memoryBus
+	options   *MQTT.ClientOptions
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	connected bool
+	routes    map[string]MQTT.MessageHandler // トピックフィルタ毎のハンドラ
+	queue     []*memoryMessage               // 配送待ちのメッセージ（順序を保持する）
+}
+
+func (client *memoryClient) IsConnected() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.connected
+}
+
+func (client *memoryClient) IsConnectionOpen() bool {
+	return client.IsConnected()
+}
+
+func (client *memoryClient) Connect() MQTT.Token {
+	client.mutex.Lock()
+	if client.connected {
+		client.mutex.Unlock()
+		return &memoryToken{}
+	}
+	client.connected = true
+	client.mutex.Unlock()
+
+	client.bus.subscribe(client)
+
+	// MQTTクライアントと同様に、受信ハンドラは専用のgoroutineで順番に実行する
+	go client.dispatch()
+	if client.options.OnConnect != nil {
+		go client.options.OnConnect(client)
+	}
+	return &memoryToken{}
+}
+
+func (client *memoryClient) Disconnect(quiesce uint) {
+	client.bus.unsubscribe(client)
+
+	// 配送待ちのメッセージを最大quiesceミリ秒まで処理させる
+	deadline := time.Now().Add(time.Duration(quiesce) * time.Millisecond)
+	for time.Now().Before(deadline) {
+		client.mutex.Lock()
+		remaining := len(client.queue)
+		client.mutex.Unlock()
+		if remaining == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	client.mutex.Lock()
+	client.connected = false
+	client.queue = nil
+	client.cond.Broadcast()
+	client.mutex.Unlock()
+}
+
+func (client *memoryClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = append([]byte{}, p...)
+	case string:
+		data = []byte(p)
+	case bytes.Buffer:
+		data = append([]byte{}, p.Bytes()...)
+	default:
+		return &memoryToken{err: fmt.Errorf("unknown payload type")}
+	}
+	if !client.IsConnected() {
+		return &memoryToken{err: MQTT.ErrNotConnected}
+	}
+	client.bus.publish(topic, retained, data)
+	return &memoryToken{}
+}
+
+func (client *memoryClient) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	return client.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (client *memoryClient) SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token {
+	if !client.IsConnected() {
+		return &memoryToken{err: MQTT.ErrNotConnected}
+	}
+	client.mutex.Lock()
+	for filter := range filters {
+		client.routes[filter] = callback
+	}
+	client.mutex.Unlock()
+
+	// 保持されたメッセージを配送
+	for _, message := range client.bus.retainedMessages(filters) {
+		client.deliver(message, true)
+	}
+	return &memoryToken{}
+}
+
+func (client *memoryClient) Unsubscribe(topics ...string) MQTT.Token {
+	client.mutex.Lock()
+	for _, topic := range topics {
+		delete(client.routes, topic)
+	}
+	client.mutex.Unlock()
+	return &memoryToken{}
+}
+
+func (client *memoryClient) AddRoute(topic string, callback MQTT.MessageHandler) {
+	client.mutex.Lock()
+	client.routes[topic] = callback
+	client.mutex.Unlock()
+}
+
+func (client *memoryClient) OptionsReader() MQTT.ClientOptionsReader {
+	// 接続しないMQTTクライアントからオプションを読み出す
+	return MQTT.NewClient(client.options).OptionsReader()
+}
+
+// deliver メッセージを配送待ちに追加する（購読していない場合は捨てる）
+func (client *memoryClient) deliver(message *memoryMessage, force bool) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if !client.connected {
+		return
+	}
+	if !force && !client.matches(message.topic) {
+		return
+	}
+	client.queue = append(client.queue, message)
+	client.cond.Signal()
+}
+
+func (client *memoryClient) matches(topic string) bool {
+	for filter := range client.routes {
+		if MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return client.options.DefaultPublishHandler != nil
+}
+
+// dispatch 配送待ちのメッセージを順番にハンドラへ渡す
+func (client *memoryClient) dispatch() {
+	for {
+		client.mutex.Lock()
+		for client.connected && len(client.queue) == 0 {
+			client.cond.Wait()
+		}
+		if !client.connected {
+			client.mutex.Unlock()
+			return
+		}
+		message := client.queue[0]
+		client.queue = client.queue[1:]
+		handlers := []MQTT.MessageHandler{}
+		for filter, handler := range client.routes {
+			if MatchTopic(filter, message.topic) {
+				handlers = append(handlers, handler)
+			}
+		}
+		client.mutex.Unlock()
+
+		if len(handlers) == 0 && client.options.DefaultPublishHandler != nil {
+			handlers = append(handlers, client.options.DefaultPublishHandler)
+		}
+		for _, handler := range handlers {
+			handler(client, message)
+		}
+	}
+}
+
+// memoryMessage MQTT.Messageを満たすメッセージ
+type memoryMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (message *memoryMessage) Duplicate() bool   { return false }
+func (message *memoryMessage) Qos() byte         { return 0 }
+func (message *memoryMessage) Retained() bool    { return message.retained }
+func (message *memoryMessage) Topic() string     { return message.topic }
+func (message *memoryMessage) MessageID() uint16 { return 0 }
+func (message *memoryMessage) Payload() []byte   { return message.payload }
+func (message *memoryMessage) Ack()              {}
+
+// memoryToken 即座に完了するトークン
+type memoryToken struct {
+	err error
+}
+
+func (token *memoryToken) Wait() bool                     { return true }
+func (token *memoryToken) WaitTimeout(time.Duration) bool { return true }
+func (token *memoryToken) Error() error                   { return token.err }
+func (token *memoryToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
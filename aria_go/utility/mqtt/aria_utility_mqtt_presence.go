@@ -0,0 +1,70 @@
+package aria_utility_mqtt
+
+import (
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Presence Universeに参加するモジュールの生存通知（aria/heartbeat）と離脱通知（aria/leave）
+type Presence struct {
+	client   MQTT.Client
+	topics   Topics
+	moduleID string
+	session  string
+	stop     chan bool
+}
+
+// SetLeaveWill 異常切断した場合にブローカーが離脱通知を配送するようにする（接続前に呼ぶ、セッションはクライアントID）
+func SetLeaveWill(opts *MQTT.ClientOptions, topics Topics, moduleID string) {
+	bytes := Encode(&LeaveEntity{
+		ID:      moduleID,
+		Session: opts.ClientID,
+	})
+	opts.SetBinaryWill(topics.Leave(), bytes, 0, false)
+}
+
+// StartPresence 指定間隔（ミリ秒）での生存通知を開始する（0以下の場合は通知しない）
+func StartPresence(client MQTT.Client, topics Topics, moduleID string, interval int) *Presence {
+	options := client.OptionsReader()
+	presence := &Presence{
+		client:   client,
+		topics:   topics,
+		moduleID: moduleID,
+		session:  options.ClientID(),
+		stop:     make(chan bool),
+	}
+	if interval > 0 {
+		go presence.run(time.Duration(interval) * time.Millisecond)
+	}
+	return presence
+}
+
+func (presence *Presence) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	bytes := Encode(&HeartbeatEntity{
+		ID:      presence.moduleID,
+		Session: presence.session,
+	})
+	for {
+		select {
+		case <-presence.stop:
+			return
+		case <-ticker.C:
+			if presence.client.IsConnected() {
+				presence.client.Publish(presence.topics.Heartbeat(), 0, false, bytes).Wait()
+			}
+		}
+	}
+}
+
+// Leave 生存通知を止めて、離脱をPublishする（切断の前に呼ぶ）
+func (presence *Presence) Leave() {
+	close(presence.stop)
+	bytes := Encode(&LeaveEntity{
+		ID:      presence.moduleID,
+		Session: presence.session,
+	})
+	presence.client.Publish(presence.topics.Leave(), 0, false, bytes).Wait()
+}
@@ -0,0 +1,140 @@
+package aria_utility_mqtt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 記録するトピックの種類（Topicsのメソッド名）
+const (
+	RecordAttend             = "Attend"
+	RecordRegistered         = "Registered"
+	RecordCycle              = "Cycle"
+	RecordPrepared           = "Prepared"
+	RecordPersons            = "Persons"
+	RecordExchange           = "Exchange"
+	RecordExchanged          = "Exchanged"
+	RecordCheckpoint         = "Checkpoint"
+	RecordCheckpointed       = "Checkpointed"
+	RecordRestore            = "Restore"
+	RecordHeartbeat          = "Heartbeat"
+	RecordLeave              = "Leave"
+	RecordIntra              = "Intra"
+	RecordMessage            = "Message"
+	RecordMedia              = "Media"
+	RecordEvent              = "Event"
+	RecordShelters           = "Shelters"
+	RecordRouteBatchRequest  = "RouteBatchRequest"
+	RecordRouteBatchResponse = "RouteBatchResponse"
+	RecordError              = "Error"
+	RecordCount              = "Count"
+	RecordAll                = "All"
+	RecordRouteRequest       = "RouteRequest"
+	RecordStat               = "Stat"
+	RecordRouteResponse      = "RouteResponse"
+	RecordCameraFlood        = "CameraFlood"
+	RecordCameraAntenna      = "CameraAntenna"
+)
+
+// RecordEntity 記録ファイルの1行（受信したメッセージ）
+type RecordEntity struct {
+	Cycle   int             `json:"cycle"`             // 受信した時のサイクル（最初のサイクルが0、開始前は-1）
+	Step    int             `json:"step"`              // 受信した時のステップ（サイクルの最初のステップの開始前は-1）
+	Time    string          `json:"time"`              // 受信した時刻（RFC3339）
+	Elapsed int64           `json:"elapsed"`           // 記録の開始からの経過時間（ミリ秒）
+	Kind    string          `json:"kind"`              // トピックの種類
+	Topic   string          `json:"topic"`             // 受信したトピック
+	Payload json.RawMessage `json:"payload,omitempty"` // JSONのペイロード
+	Binary  []byte          `json:"binary,omitempty"`  // JSON以外のペイロード（バイナリ形式のフレームなど）
+}
+
+// RecordTopics 記録するトピックの一覧（種類 -> 購読するトピック）
+func (topics Topics) RecordTopics() map[string]string {
+	return map[string]string{
+		RecordAttend:             topics.Attend(),
+		RecordRegistered:         topics.Registered("+"),
+		RecordCycle:              topics.Cycle(),
+		RecordPrepared:           topics.Prepared(),
+		RecordPersons:            topics.Persons(),
+		RecordExchange:           topics.Exchange(),
+		RecordExchanged:          topics.Exchanged(),
+		RecordCheckpoint:         topics.Checkpoint(),
+		RecordCheckpointed:       topics.Checkpointed(),
+		RecordRestore:            topics.Restore(),
+		RecordHeartbeat:          topics.Heartbeat(),
+		RecordLeave:              topics.Leave(),
+		RecordIntra:              topics.Intra(),
+		RecordMessage:            topics.Message(),
+		RecordMedia:              topics.Media(),
+		RecordEvent:              topics.Event(),
+		RecordShelters:           topics.Shelters(),
+		RecordRouteBatchRequest:  topics.RouteBatchRequest("+"),
+		RecordRouteBatchResponse: topics.RouteBatchResponse("+"),
+		RecordError:              topics.Error(),
+		RecordCount:              topics.Count(),
+		RecordAll:                topics.All(),
+		RecordRouteRequest:       topics.RouteRequest("+"),
+		RecordStat:               topics.Stat(),
+		RecordRouteResponse:      topics.RouteResponse("+"),
+		RecordCameraFlood:        topics.CameraFlood("+"),
+		RecordCameraAntenna:      topics.CameraAntenna("+"),
+	}
+}
+
+// ReplayTopic 再生する記録のトピック（外部からの入力のみ、それ以外は空）
+// 記録した時とUniverseIDやトピック名の形式が異なっていてもよいように、種類から組み立て直す
+func (topics Topics) ReplayTopic(record RecordEntity) string {
+	id := record.Topic[strings.LastIndex(record.Topic, "/")+1:]
+	switch record.Kind {
+	case RecordCameraFlood:
+		return topics.CameraFlood(id)
+	case RecordCameraAntenna:
+		return topics.CameraAntenna(id)
+	case RecordMessage:
+		return topics.Message()
+	case RecordEvent:
+		// Universeがシナリオから出した変更も含むが、同じ変更を2回反映しても結果は変わらない
+		return topics.Event()
+	}
+	return ""
+}
+
+// PayloadBytes 記録したペイロード
+func (record RecordEntity) PayloadBytes() []byte {
+	if record.Payload != nil {
+		return record.Payload
+	}
+	return record.Binary
+}
+
+// Before 記録したサイクルとステップが指定したサイクルとステップより前か
+func (record RecordEntity) Before(cycle int, step int) bool {
+	return record.Cycle < cycle || (record.Cycle == cycle && record.Step < step)
+}
+
+// LoadRecords 記録ファイルを読み込む
+func LoadRecords(fileName string) ([]RecordEntity, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []RecordEntity{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 256*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record RecordEntity
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
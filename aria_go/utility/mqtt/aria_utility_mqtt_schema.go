@@ -0,0 +1,379 @@
+package aria_utility_mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// SchemaVersion エンティティのスキーマのバージョン（互換性のない変更をした場合に上げる）
+const SchemaVersion = 1
+
+// Header 全てのエンティティに埋め込むヘッダ（"v"を持たないペイロードはバージョン0として扱う）
+type Header struct {
+	Version int `json:"v"`
+}
+
+func (header *Header) schemaHeader() *Header {
+	return header
+}
+
+// Entity ヘッダを持つエンティティ（Encode、Decodeに渡すことができる）
+type Entity interface {
+	schemaHeader() *Header
+}
+
+// validator タグで表せない検証を持つエンティティ
+type validator interface {
+	validate() error
+}
+
+// maximumErrorPayload aria/error/+に載せるペイロードの最大長
+const maximumErrorPayload = 256
+
+// Encode 現在のバージョンを設定して、エンティティをJSONにする
+func Encode(entity Entity) []byte {
+	entity.schemaHeader().Version = SchemaVersion
+	bytes, _ := json.Marshal(entity)
+	return bytes
+}
+
+// Decode JSONのペイロードを厳密に解釈して、検証する
+// 未知のフィールドはエラー（バージョン0のペイロードのみ無視する）、新しいバージョンのペイロードもエラー
+func Decode(payload []byte, entity Entity) error {
+	if err := json.Unmarshal(payload, entity); err != nil {
+		return err
+	}
+	version := entity.schemaHeader().Version
+	if version > SchemaVersion {
+		return fmt.Errorf("unsupported schema version %d (supported %d)", version, SchemaVersion)
+	}
+	if version > 0 {
+		if path := unknownField(payload, reflect.TypeOf(entity), ""); path != "" {
+			return fmt.Errorf("%s: unknown field", path)
+		}
+	}
+	return Validate(entity)
+}
+
+// unknownField ペイロードにあってエンティティにないフィールドのパス（ない場合は空）
+// フィールド名はjson.Unmarshalと同じく大文字と小文字を区別しない
+func unknownField(payload json.RawMessage, valueType reflect.Type, path string) string {
+	for valueType.Kind() == reflect.Ptr {
+		valueType = valueType.Elem()
+	}
+	switch valueType.Kind() {
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(payload, &items) != nil {
+			return ""
+		}
+		for i, item := range items {
+			if unknown := unknownField(item, valueType.Elem(), fmt.Sprintf("%s[%d]", path, i)); unknown != "" {
+				return unknown
+			}
+		}
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(payload, &fields) != nil {
+			return ""
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field, exists := fieldByName(valueType, name)
+			if !exists {
+				return joinPath(path, name)
+			}
+			if unknown := unknownField(fields[name], field.Type, joinPath(path, name)); unknown != "" {
+				return unknown
+			}
+		}
+	}
+	return ""
+}
+
+// fieldByName JSONの名前のフィールド（埋め込んだ構造体のフィールドを含む）
+func fieldByName(valueType reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if field.Anonymous {
+			if embedded, exists := fieldByName(field.Type, name); exists {
+				return embedded, true
+			}
+			continue
+		}
+		if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+			continue
+		}
+		if strings.EqualFold(jsonName(field), name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// Validate schemaタグと各エンティティの検証を行う
+func Validate(entity interface{}) error {
+	if err := validateValue(reflect.ValueOf(entity), ""); err != nil {
+		return err
+	}
+	if entity, ok := entity.(validator); ok {
+		return entity.validate()
+	}
+	return nil
+}
+
+func validateValue(value reflect.Value, path string) error {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return nil
+		}
+		return validateValue(value.Elem(), path)
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			if err := validateValue(value.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			fieldPath := path
+			if !field.Anonymous {
+				fieldPath = joinPath(path, jsonName(field))
+			}
+			if err := validateField(value.Field(i), field.Tag.Get("schema"), fieldPath); err != nil {
+				return err
+			}
+			if err := validateValue(value.Field(i), fieldPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateField(value reflect.Value, tag string, path string) error {
+	for _, rule := range schemaRules(tag) {
+		switch rule.name {
+		case "required":
+			if value.Kind() == reflect.String && value.Len() == 0 {
+				return fmt.Errorf("%s: required", path)
+			}
+		case "min":
+			if number, ok := numberOf(value); ok && number < rule.value {
+				return fmt.Errorf("%s: %v is less than %v", path, number, rule.value)
+			}
+		case "max":
+			if number, ok := numberOf(value); ok && number > rule.value {
+				return fmt.Errorf("%s: %v is greater than %v", path, number, rule.value)
+			}
+		}
+	}
+	return nil
+}
+
+// schemaRule schemaタグの1項目（required、min=N、max=N）
+type schemaRule struct {
+	name  string
+	value float64
+}
+
+func schemaRules(tag string) []schemaRule {
+	rules := []schemaRule{}
+	if tag == "" {
+		return rules
+	}
+	for _, item := range strings.Split(tag, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		rule := schemaRule{name: parts[0]}
+		if len(parts) == 2 {
+			rule.value, _ = strconv.ParseFloat(parts[1], 64)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func numberOf(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	}
+	return 0, false
+}
+
+func jsonName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func (entity *RegisteredEntity) validate() error {
+	if entity.From > entity.To {
+		return fmt.Errorf("from: %d is greater than to %d", entity.From, entity.To)
+	}
+	return nil
+}
+
+func (entity *CameraEntity) validate() error {
+	if entity.Right <= entity.Left {
+		return fmt.Errorf("rb_x: %d must be greater than lt_x %d", entity.Right, entity.Left)
+	}
+	if entity.Bottom <= entity.Top {
+		return fmt.Errorf("rb_y: %d must be greater than lt_y %d", entity.Bottom, entity.Top)
+	}
+	return nil
+}
+
+// ReportError 受信したメッセージのエラーを表示して、aria/error/+にPublishする
+func ReportError(client MQTT.Client, topics Topics, reporter string, msg MQTT.Message, err error) {
+	fmt.Printf("[Error   ] %s : %s\n", msg.Topic(), err)
+
+	payload := msg.Payload()
+	text := fmt.Sprintf("(binary frame, %d bytes)", len(payload))
+	if !isFrame(payload) {
+		if len(payload) > maximumErrorPayload {
+			payload = payload[:maximumErrorPayload]
+		}
+		text = string(payload)
+	}
+	client.Publish(topics.Error(), 0, false, Encode(&ErrorEntity{
+		ID:      reporter,
+		Topic:   msg.Topic(),
+		Error:   err.Error(),
+		Payload: text,
+	}))
+}
+
+// schemaEntry スキーマを出力するエンティティ
+type schemaEntry struct {
+	name   string
+	topic  string
+	entity interface{}
+}
+
+var schemaEntries = []schemaEntry{
+	{"AttendEntity", "aria/attend/<universe>", AttendEntity{}},
+	{"RegisteredEntity", "aria/registered/<universe>/<module>", RegisteredEntity{}},
+	{"CycleEntity", "aria/cycle/<universe>", CycleEntity{}},
+	{"PreparedEntity", "aria/prepared/<universe>", PreparedEntity{}},
+	{"StepEntity", "aria/persons/<universe>", StepEntity{}},
+	{"ExchangeEntity", "aria/exchange/<universe>", ExchangeEntity{}},
+	{"ExchangedEntity", "aria/exchanged/<universe>", ExchangedEntity{}},
+	{"CheckpointEntity", "aria/checkpoint/<universe>, aria/restore/<universe>", CheckpointEntity{}},
+	{"CheckpointedEntity", "aria/checkpointed/<universe>", CheckpointedEntity{}},
+	{"HeartbeatEntity", "aria/heartbeat/<universe>", HeartbeatEntity{}},
+	{"LeaveEntity", "aria/leave/<universe>", LeaveEntity{}},
+	{"IntraEntity", "aria/intra/persons/<universe>", IntraEntity{}},
+	{"MessageEntity", "aria/message/<universe>", MessageEntity{}},
+	{"MediaEntity", "aria/media/<universe>", MediaEntity{}},
+	{"EventEntity", "aria/event/<universe>", EventEntity{}},
+	{"SheltersEntity", "aria/shelters/<universe>", SheltersEntity{}},
+	{"RouteBatchEntity", "aria/route/request/<universe>/<module>", RouteBatchEntity{}},
+	{"RouteBatchResultEntity", "aria/route/response/<universe>/<module>", RouteBatchResultEntity{}},
+	{"ErrorEntity", "aria/error/<universe>", ErrorEntity{}},
+	{"CountEntity", "/flood/count/<universe> (legacy: /flood/count)", CountEntity{}},
+	{"AllEntity", "/person/send/all/<universe> (array, legacy: /person/send/all)", AllEntity{}},
+	{"RouteEntity", "/person/send/start2target/<universe>/<person> (legacy: /person/send/start2target/<person>)", RouteEntity{}},
+	{"RouteFailureEntity", "/person/recv/start2target/<universe>/<person> (legacy: /person/recv/start2target/<person>)", RouteFailureEntity{}},
+	{"StatusEntity", "/stat/send/<universe> (legacy: /stat/send)", StatusEntity{}},
+	{"CameraEntity", "/camera/flood/<universe>/<id>, /camera/antenna/<universe>/<id> (legacy: /camera/flood/<id>, /camera/antenna/<id>)", CameraEntity{}},
+}
+
+// Schema 全てのエンティティのJSON Schema（draft-07）を生成する
+func Schema() []byte {
+	definitions := map[string]interface{}{}
+	for _, entry := range schemaEntries {
+		definition := schemaOf(reflect.TypeOf(entry.entity))
+		definition["title"] = entry.name
+		definition["description"] = entry.topic
+		definitions[entry.name] = definition
+	}
+	bytes, _ := json.MarshalIndent(map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"$id":         fmt.Sprintf("aria/schema/v%d", SchemaVersion),
+		"title":       "ARIA MQTT entities",
+		"description": "Payloads without \"v\" (or with v 0) are legacy payloads: unknown fields are ignored. Payloads with the current v reject unknown fields.",
+		"version":     SchemaVersion,
+		"definitions": definitions,
+	}, "", "  ")
+	return bytes
+}
+
+func schemaOf(valueType reflect.Type) map[string]interface{} {
+	switch valueType.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaOf(valueType.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []string{}
+		addProperties(valueType, properties, &required)
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+func addProperties(valueType reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if field.Anonymous {
+			addProperties(field.Type, properties, required)
+			continue
+		}
+		property := schemaOf(field.Type)
+		if valueType == reflect.TypeOf(Header{}) {
+			property["enum"] = []int{0, SchemaVersion}
+		}
+		for _, rule := range schemaRules(field.Tag.Get("schema")) {
+			switch rule.name {
+			case "required":
+				*required = append(*required, jsonName(field))
+				if field.Type.Kind() == reflect.String {
+					property["minLength"] = 1
+				}
+			case "min":
+				property["minimum"] = rule.value
+			case "max":
+				property["maximum"] = rule.value
+			}
+		}
+		properties[jsonName(field)] = property
+	}
+}
@@ -0,0 +1,96 @@
+package aria_utility_mqtt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeUnknownFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		err     string // エラーに含まれる文字列（空：エラーなし）
+	}{
+		{"known fields", `{"v":1,"id":"p","count":3,"persons":[{"id":1}],"shelters":[{"nid":2,"occupancy":1}]}`, ""},
+		{"case insensitive", `{"v":1,"ID":"p","Count":3}`, ""},
+		{"unknown field", `{"v":1,"id":"p","extra":1}`, "extra: unknown field"},
+		{"unknown nested field", `{"v":1,"id":"p","persons":[{"id":1},{"id":2,"extra":1}]}`, "persons[1].extra: unknown field"},
+		{"legacy without v", `{"id":"p","extra":1}`, ""},
+		{"legacy v 0", `{"v":0,"id":"p","persons":[{"extra":1}]}`, ""},
+		{"newer version", `{"v":2,"id":"p"}`, "unsupported schema version"},
+		{"trailing data", `{"v":1,"id":"p"} {}`, "after top-level value"},
+		{"wrong type", `{"v":1,"id":"p","count":"3"}`, "cannot unmarshal"},
+		{"invalid value", `{"v":1,"id":"","count":3}`, "id"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Decode([]byte(test.payload), &StepEntity{})
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("Decode(%s) = %v", test.payload, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Decode(%s) = %v, want error containing %q", test.payload, err, test.err)
+			}
+		})
+	}
+}
+
+// スキーマに書いたトピックはTopicsで組み立てたトピックと同じ
+func TestSchemaTopics(t *testing.T) {
+	builders := map[string]func(topics Topics) []string{
+		"AttendEntity":           func(topics Topics) []string { return []string{topics.Attend()} },
+		"RegisteredEntity":       func(topics Topics) []string { return []string{topics.Registered("<module>")} },
+		"CycleEntity":            func(topics Topics) []string { return []string{topics.Cycle()} },
+		"PreparedEntity":         func(topics Topics) []string { return []string{topics.Prepared()} },
+		"StepEntity":             func(topics Topics) []string { return []string{topics.Persons()} },
+		"ExchangeEntity":         func(topics Topics) []string { return []string{topics.Exchange()} },
+		"ExchangedEntity":        func(topics Topics) []string { return []string{topics.Exchanged()} },
+		"CheckpointEntity":       func(topics Topics) []string { return []string{topics.Checkpoint(), topics.Restore()} },
+		"CheckpointedEntity":     func(topics Topics) []string { return []string{topics.Checkpointed()} },
+		"HeartbeatEntity":        func(topics Topics) []string { return []string{topics.Heartbeat()} },
+		"LeaveEntity":            func(topics Topics) []string { return []string{topics.Leave()} },
+		"IntraEntity":            func(topics Topics) []string { return []string{topics.Intra()} },
+		"MessageEntity":          func(topics Topics) []string { return []string{topics.Message()} },
+		"MediaEntity":            func(topics Topics) []string { return []string{topics.Media()} },
+		"EventEntity":            func(topics Topics) []string { return []string{topics.Event()} },
+		"SheltersEntity":         func(topics Topics) []string { return []string{topics.Shelters()} },
+		"RouteBatchEntity":       func(topics Topics) []string { return []string{topics.RouteBatchRequest("<module>")} },
+		"RouteBatchResultEntity": func(topics Topics) []string { return []string{topics.RouteBatchResponse("<module>")} },
+		"ErrorEntity":            func(topics Topics) []string { return []string{topics.Error()} },
+		"CountEntity":            func(topics Topics) []string { return []string{topics.Count()} },
+		"AllEntity":              func(topics Topics) []string { return []string{topics.All()} },
+		"RouteEntity":            func(topics Topics) []string { return []string{topics.RouteRequest("<person>")} },
+		"RouteFailureEntity":     func(topics Topics) []string { return []string{topics.RouteResponse("<person>")} },
+		"StatusEntity":           func(topics Topics) []string { return []string{topics.Stat()} },
+		"CameraEntity": func(topics Topics) []string {
+			return []string{topics.CameraFlood("<id>"), topics.CameraAntenna("<id>")}
+		},
+	}
+	for _, entry := range schemaEntries {
+		build, exists := builders[entry.name]
+		if !exists {
+			t.Errorf("%s: no Topics builder to check %q against", entry.name, entry.topic)
+			continue
+		}
+
+		// "トピック, トピック (注記, legacy: トピック, トピック)"
+		documented, note := entry.topic, ""
+		if i := strings.Index(documented, " ("); i >= 0 {
+			documented, note = documented[:i], strings.TrimSuffix(documented[i+2:], ")")
+		}
+		if want := strings.Join(build(NewTopics("<universe>", false)), ", "); documented != want {
+			t.Errorf("%s: documented topic %q, Topics builds %q", entry.name, documented, want)
+		}
+		legacy := build(NewTopics("<universe>", true))
+		if i := strings.Index(note, "legacy: "); i >= 0 {
+			if documented := note[i+len("legacy: "):]; documented != strings.Join(legacy, ", ") {
+				t.Errorf("%s: documented legacy topic %q, Topics builds %q", entry.name, documented, strings.Join(legacy, ", "))
+			}
+		} else if strings.Join(legacy, ", ") != documented {
+			t.Errorf("%s: legacy topic %q is not documented", entry.name, strings.Join(legacy, ", "))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package aria_utility_mqtt
+
+import "fmt"
+
+// Topics UniverseID毎のトピック名を組み立てる
+// 全てのモジュールはこの構造体からトピック名を取得する（トピック名を直接書かない）
+type Topics struct {
+	UniverseID string
+	Legacy     bool // 可視化ツール向けの旧トピック名（/flood/count など、UniverseIDを含まない）を使う
+}
+
+// NewTopics トピック名の組み立てを生成する
+func NewTopics(universeID string, legacy bool) Topics {
+	return Topics{
+		UniverseID: universeID,
+		Legacy:     legacy,
+	}
+}
+
+// Attend aria/attend/<universe>（Universe <- Person）
+func (topics Topics) Attend() string {
+	return fmt.Sprintf("aria/attend/%s", topics.UniverseID)
+}
+
+// Registered aria/registered/<universe>/<module>（Universe -> Person）
+func (topics Topics) Registered(moduleID string) string {
+	return fmt.Sprintf("aria/registered/%s/%s", topics.UniverseID, moduleID)
+}
+
+// Cycle aria/cycle/<universe>（Universe -> Person）
+func (topics Topics) Cycle() string {
+	return fmt.Sprintf("aria/cycle/%s", topics.UniverseID)
+}
+
+// Prepared aria/prepared/<universe>（Universe <- Person）
+func (topics Topics) Prepared() string {
+	return fmt.Sprintf("aria/prepared/%s", topics.UniverseID)
+}
+
+// Persons aria/persons/<universe>（Universe <- Person）
+func (topics Topics) Persons() string {
+	return fmt.Sprintf("aria/persons/%s", topics.UniverseID)
+}
+
+// Exchange aria/exchange/<universe>（Universe -> Person）
+func (topics Topics) Exchange() string {
+	return fmt.Sprintf("aria/exchange/%s", topics.UniverseID)
+}
+
+// Exchanged aria/exchanged/<universe>（Universe <- Person）
+func (topics Topics) Exchanged() string {
+	return fmt.Sprintf("aria/exchanged/%s", topics.UniverseID)
+}
+
+// Checkpoint aria/checkpoint/<universe>（Universe -> 全て）
+func (topics Topics) Checkpoint() string {
+	return fmt.Sprintf("aria/checkpoint/%s", topics.UniverseID)
+}
+
+// Checkpointed aria/checkpointed/<universe>（Universe <- Person）
+func (topics Topics) Checkpointed() string {
+	return fmt.Sprintf("aria/checkpointed/%s", topics.UniverseID)
+}
+
+// Restore aria/restore/<universe>（Universe -> 全て）
+func (topics Topics) Restore() string {
+	return fmt.Sprintf("aria/restore/%s", topics.UniverseID)
+}
+
+// Heartbeat aria/heartbeat/<universe>（Universe <- Person）
+func (topics Topics) Heartbeat() string {
+	return fmt.Sprintf("aria/heartbeat/%s", topics.UniverseID)
+}
+
+// Leave aria/leave/<universe>（Universe <- Person）
+func (topics Topics) Leave() string {
+	return fmt.Sprintf("aria/leave/%s", topics.UniverseID)
+}
+
+// Intra aria/intra/persons/<universe>（Person <-> Person）
+func (topics Topics) Intra() string {
+	return fmt.Sprintf("aria/intra/persons/%s", topics.UniverseID)
+}
+
+// Error aria/error/<universe>（全て -> 外部）
+func (topics Topics) Error() string {
+	return fmt.Sprintf("aria/error/%s", topics.UniverseID)
+}
+
+// Message aria/message/<universe>
+func (topics Topics) Message() string {
+	return fmt.Sprintf("aria/message/%s", topics.UniverseID)
+}
+
+// Media aria/media/<universe>（Media -> Potential）
+func (topics Topics) Media() string {
+	return fmt.Sprintf("aria/media/%s", topics.UniverseID)
+}
+
+// Event aria/event/<universe>（Universe・外部 -> Routing・Person）
+func (topics Topics) Event() string {
+	return fmt.Sprintf("aria/event/%s", topics.UniverseID)
+}
+
+// Shelters aria/shelters/<universe>（Universe -> 全て）
+func (topics Topics) Shelters() string {
+	return fmt.Sprintf("aria/shelters/%s", topics.UniverseID)
+}
+
+// RouteBatchRequest aria/route/request/<universe>/<module>（モジュール毎の経路要求、Person -> Routing、購読時は"+"を指定）
+func (topics Topics) RouteBatchRequest(moduleID string) string {
+	return fmt.Sprintf("aria/route/request/%s/%s", topics.UniverseID, moduleID)
+}
+
+// RouteBatchResponse aria/route/response/<universe>/<module>（Routing -> Person、購読時は"+"を指定）
+func (topics Topics) RouteBatchResponse(moduleID string) string {
+	return fmt.Sprintf("aria/route/response/%s/%s", topics.UniverseID, moduleID)
+}
+
+// Count (1) /flood/count/<universe>（ステップの開始、Universe -> 全て）
+func (topics Topics) Count() string {
+	return topics.legacy("/flood/count")
+}
+
+// All (2) /person/send/all/<universe>
+func (topics Topics) All() string {
+	return topics.legacy("/person/send/all")
+}
+
+// RouteRequest (3) /person/send/start2target/<universe>/<person>（購読時は"+"を指定）
+func (topics Topics) RouteRequest(personID string) string {
+	return topics.legacy("/person/send/start2target") + "/" + personID
+}
+
+// Stat (4) /stat/send/<universe>
+func (topics Topics) Stat() string {
+	return topics.legacy("/stat/send")
+}
+
+// RouteResponse (5) /person/recv/start2target/<universe>/<person>（購読時は"+"を指定）
+func (topics Topics) RouteResponse(personID string) string {
+	return topics.legacy("/person/recv/start2target") + "/" + personID
+}
+
+// CameraFlood (6) /camera/flood/<universe>/<id>（購読時は"+"を指定）
+func (topics Topics) CameraFlood(id string) string {
+	return topics.legacy("/camera/flood") + "/" + id
+}
+
+// CameraAntenna (7) /camera/antenna/<universe>/<id>（購読時は"+"を指定）
+func (topics Topics) CameraAntenna(id string) string {
+	return topics.legacy("/camera/antenna") + "/" + id
+}
+
+// legacy 旧トピック名の場合はそのまま、それ以外はUniverseIDを付ける
+func (topics Topics) legacy(topic string) string {
+	if topics.Legacy {
+		return topic
+	}
+	return fmt.Sprintf("%s/%s", topic, topics.UniverseID)
+}
@@ -1,3 +1,5 @@
 module aria_utility_mqtt.go
 
 go 1.16
+
+require github.com/eclipse/paho.mqtt.golang v1.3.4
@@ -11,26 +11,43 @@ import (
 
 // NodeEntity 近隣のノード情報を含むノードのエンティティ
 type NodeEntity struct {
-	NID       int
-	X         float64
-	Y         float64
-	Height    float64
-	IsShelter bool
-	Neighbors []NeighborEntity
-	From      int
-	Flood     float64
+	NID             int
+	X               float64
+	Y               float64
+	Height          float64
+	IsShelter       bool
+	IsDesignated    bool // 指定避難場所（避難場所ファイルの5列目が1）
+	Capacity        int  // 避難場所の収容人数（0：無制限）
+	Neighbors       []NeighborEntity
+	ClosedNeighbors []NeighborEntity // 通行止めのリンク（解除した場合はNeighborsに戻す）
+	Flood           float64
+	Forecast        []float64 // 先のステップの予測水深（Forecast[0]が次のステップ、経路計算用）
 }
 
 // NeighborEntity 近隣のノード＋そこまでの距離
 type NeighborEntity struct {
-	Node   *NodeEntity
-	Length float64
+	Node     *NodeEntity
+	Length   float64
+	LinkID   int     // リンクのID（LinkFilePathの1列目）
+	Width    float64 // リンクの幅（LinkFilePathの5列目、省略した場合は0）
+	Capacity int     // リンクに同時にいられる人数（LinkFilePathの6列目、省略した場合は0：幅とJamDensityから求める）
+}
+
+// IsOpen 避難場所として受け入れられるか（収容人数に達した避難場所は受け入れない）
+func (node *NodeEntity) IsOpen(occupancy map[int]int) bool {
+	return node.IsShelter && (node.Capacity == 0 || occupancy[node.NID] < node.Capacity)
 }
 
 // TODO : 最終的にマップサイズを設定ファイルから取得するように変更する
 // LoadMap 地図情報（ノードとリンクを含む）を読み込む
 func LoadMap(settings aria_utility_settings.SettingEntity, nodeEntity aria_utility_settings.SettingNodeEntity) map[int]*NodeEntity {
+	return LoadScenarioMap(settings, nodeEntity, aria_utility_settings.ScenarioCycleEntity{})
+}
+
+// LoadScenarioMap シナリオのサイクルの変更（避難場所のファイル、開設と閉鎖、通行止め）を反映した地図情報を読み込む
+func LoadScenarioMap(settings aria_utility_settings.SettingEntity, nodeEntity aria_utility_settings.SettingNodeEntity, cycle aria_utility_settings.ScenarioCycleEntity) map[int]*NodeEntity {
 	var nodes map[int]*NodeEntity = make(map[int]*NodeEntity)
+	nodeEntity = cycle.ApplyNode(nodeEntity)
 
 	// ノードCSVファイルの読込－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
 	file, _ := os.Open(nodeEntity.NodeFilePath)
@@ -61,7 +78,6 @@ func LoadMap(settings aria_utility_settings.SettingEntity, nodeEntity aria_utili
 			Height:    height,
 			IsShelter: false,
 			Neighbors: []NeighborEntity{},
-			From:      -1,
 			Flood:     0,
 		}
 	}
@@ -80,22 +96,38 @@ func LoadMap(settings aria_utility_settings.SettingEntity, nodeEntity aria_utili
 			break
 		}
 
+		id, _ := strconv.Atoi(line[0])
 		nid1, _ := strconv.ParseInt(line[1], 10, 64)
 		nid2, _ := strconv.ParseInt(line[2], 10, 64)
 		length, _ := strconv.ParseFloat(line[3], 64)
+		width := 0.0
+		if len(line) > 4 {
+			width, _ = strconv.ParseFloat(line[4], 64)
+		}
+		capacity := 0
+		if len(line) > 5 {
+			capacity, _ = strconv.Atoi(line[5])
+		}
 
 		nodes[int(nid1)].Neighbors = append(nodes[int(nid1)].Neighbors, NeighborEntity{
-			Node:   nodes[int(nid2)],
-			Length: length,
+			Node:     nodes[int(nid2)],
+			Length:   length,
+			LinkID:   id,
+			Width:    width,
+			Capacity: capacity,
 		})
 		nodes[int(nid2)].Neighbors = append(nodes[int(nid2)].Neighbors, NeighborEntity{
-			Node:   nodes[int(nid1)],
-			Length: length,
+			Node:     nodes[int(nid1)],
+			Length:   length,
+			LinkID:   id,
+			Width:    width,
+			Capacity: capacity,
 		})
 	}
 	// －－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
 
 	// シェルターCSVファイルの読み込み－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
+	// 4列目は収容人数（省略や0は無制限、同じノードに複数の避難場所がある場合は合計）、5列目は指定避難場所（1：指定）
 	file, _ = os.Open(nodeEntity.ShelterFilePath)
 	reader = csv.NewReader(file)
 	reader.FieldsPerRecord = -1
@@ -117,14 +149,42 @@ func LoadMap(settings aria_utility_settings.SettingEntity, nodeEntity aria_utili
 		var target *NodeEntity
 		for _, node := range nodes {
 			length := (x-node.X)*(x-node.X) + (y-node.Y)*(y-node.Y)
-			if length < max {
+			if length < max || (length == max && node.NID < target.NID) {
 				max = length
 				target = node
 			}
 		}
+		capacity := 0
+		if len(line) > 3 {
+			capacity, _ = strconv.Atoi(line[3])
+		}
+		if capacity < 0 {
+			capacity = 0
+		}
+		if !target.IsShelter {
+			target.Capacity = capacity
+		} else if target.Capacity > 0 && capacity > 0 {
+			target.Capacity += capacity
+		} else {
+			target.Capacity = 0
+		}
 		target.IsShelter = true
+		if len(line) > 4 && line[4] == "1" {
+			target.IsDesignated = true
+		}
 	}
 	// －－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－－
 
+	// 避難場所の開設と閉鎖、通行止め
+	for _, nid := range cycle.OpenShelters {
+		setShelter(nodes, nid, true)
+	}
+	for _, nid := range cycle.ClosedShelters {
+		setShelter(nodes, nid, false)
+	}
+	for _, id := range cycle.ClosedLinks {
+		setLinkClosed(nodes, id, true)
+	}
+
 	return nodes
 }
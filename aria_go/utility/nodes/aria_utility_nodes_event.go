@@ -0,0 +1,124 @@
+package aria_utility_nodes
+
+import (
+	"fmt"
+	"sort"
+)
+
+// 地図の変更の種類（aria/event/+のtype、シナリオのEventsのType）
+const (
+	EventShelterOpen  = "shelter_open"  // 避難場所を開設する（対象はノードのID）
+	EventShelterClose = "shelter_close" // 避難場所を閉鎖する（満員や危険になった場合、対象はノードのID）
+	EventLinkClose    = "link_close"    // リンクを通行止めにする（対象はリンクのID）
+	EventLinkOpen     = "link_open"     // リンクの通行止めを解除する（対象はリンクのID）
+)
+
+// MapEvent 地図の変更
+type MapEvent struct {
+	Step   int    // このステップの開始時に反映する（受信した時に過ぎている場合は次のステップ）
+	Type   string // EventShelterOpenなど
+	Target int    // ノードのID、またはリンクのID
+}
+
+// MapEvents サイクル中に受信した地図の変更
+type MapEvents struct {
+	Pending []MapEvent // 反映を待っている変更（受信順）
+	Applied []MapEvent // 反映した変更（反映順、チェックポイントから再開した時に同じ順で反映し直す）
+}
+
+// ValidateEvent 変更の種類と対象が地図にあるかの検証
+func ValidateEvent(nodes map[int]*NodeEntity, event MapEvent) error {
+	switch event.Type {
+	case EventShelterOpen, EventShelterClose:
+		if _, exists := nodes[event.Target]; !exists {
+			return fmt.Errorf("target: unknown node %d", event.Target)
+		}
+	case EventLinkClose, EventLinkOpen:
+		for _, node := range nodes {
+			for _, neighbors := range [][]NeighborEntity{node.Neighbors, node.ClosedNeighbors} {
+				for _, neighbor := range neighbors {
+					if neighbor.LinkID == event.Target {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("target: unknown link %d", event.Target)
+	default:
+		return fmt.Errorf("type: unknown event type %q", event.Type)
+	}
+	return nil
+}
+
+// Add 変更を受け付ける
+func (events *MapEvents) Add(event MapEvent) {
+	events.Pending = append(events.Pending, event)
+}
+
+// Apply ステップの開始時に、反映するステップになった変更を受信順に反映する
+func (events *MapEvents) Apply(nodes map[int]*NodeEntity, count int) {
+	pending := []MapEvent{}
+	for _, event := range events.Pending {
+		if event.Step > count {
+			pending = append(pending, event)
+			continue
+		}
+		applyEvent(nodes, event)
+		events.Applied = append(events.Applied, event)
+	}
+	events.Pending = pending
+}
+
+// Reapply 反映済みの変更を読み込み直した地図に反映する
+func (events *MapEvents) Reapply(nodes map[int]*NodeEntity) {
+	for _, event := range events.Applied {
+		applyEvent(nodes, event)
+	}
+}
+
+// 変更を地図に反映する
+func applyEvent(nodes map[int]*NodeEntity, event MapEvent) {
+	switch event.Type {
+	case EventShelterOpen:
+		setShelter(nodes, event.Target, true)
+	case EventShelterClose:
+		setShelter(nodes, event.Target, false)
+	case EventLinkClose:
+		setLinkClosed(nodes, event.Target, true)
+	case EventLinkOpen:
+		setLinkClosed(nodes, event.Target, false)
+	}
+}
+
+// 避難場所の開設と閉鎖
+func setShelter(nodes map[int]*NodeEntity, nid int, isShelter bool) {
+	if node, exists := nodes[nid]; exists {
+		node.IsShelter = isShelter
+	}
+}
+
+// リンクの通行止めと解除（両端のノードの近隣ノードを移し替える）
+// 経路計算の結果が変更の順に依存しないように、解除した場合はリンクのID順に戻す
+func setLinkClosed(nodes map[int]*NodeEntity, linkID int, isClosed bool) {
+	for _, node := range nodes {
+		from, to := &node.Neighbors, &node.ClosedNeighbors
+		if !isClosed {
+			from, to = to, from
+		}
+		kept := []NeighborEntity{}
+		for _, neighbor := range *from {
+			if neighbor.LinkID == linkID {
+				*to = append(*to, neighbor)
+			} else {
+				kept = append(kept, neighbor)
+			}
+		}
+		if len(kept) == len(*from) {
+			continue
+		}
+		*from = kept
+		if !isClosed {
+			sort.SliceStable(node.Neighbors, func(i, j int) bool { return node.Neighbors[i].LinkID < node.Neighbors[j].LinkID })
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package aria_utility_nodes
+
+import (
+	"aria_utility_settings"
+	"math"
+)
+
+// 設定ファイルのMinimumSpeedRatioが0の場合の割合
+const defaultMinimumSpeedRatio = 0.1
+
+// Link nodeからnidに向かうリンク（同じノードを結ぶリンクが複数ある場合は最後のもの）
+func (node *NodeEntity) Link(nid int) (NeighborEntity, bool) {
+	link, exists := NeighborEntity{}, false
+	for _, neighbor := range node.Neighbors {
+		if neighbor.Node.NID == nid {
+			link, exists = neighbor, true
+		}
+	}
+	return link, exists
+}
+
+// area リンクの面積（m²、幅がわからない場合は0）
+func (link NeighborEntity) area(movement aria_utility_settings.SettingMovementEntity) float64 {
+	width := link.Width
+	if width == 0 {
+		width = movement.DefaultWidth
+	}
+	return link.Length * width
+}
+
+// LinkCapacity リンクに同時にいられる人数（0：無制限）
+// LinkFilePathの6列目、省略した場合は密度がJamDensityになる人数（幅もわからない場合は無制限）
+func (link NeighborEntity) LinkCapacity(movement aria_utility_settings.SettingMovementEntity) int {
+	if movement.JamDensity <= 0 {
+		return 0
+	}
+	if link.Capacity > 0 {
+		return link.Capacity
+	}
+	area := link.area(movement)
+	if area <= 0 {
+		return 0
+	}
+	return int(math.Max(1, math.Floor(movement.JamDensity*area)))
+}
+
+// SpeedRatio リンクにpersons人いる場合の歩く速さの割合（基本図、密度がJamDensityに近づくにつれて線形に遅くなる）
+func (link NeighborEntity) SpeedRatio(movement aria_utility_settings.SettingMovementEntity, persons int) float64 {
+	area := link.area(movement)
+	if movement.JamDensity <= 0 || area <= 0 || persons == 0 {
+		return 1
+	}
+	minimum := movement.MinimumSpeedRatio
+	if minimum == 0 {
+		minimum = defaultMinimumSpeedRatio
+	}
+	return math.Max(minimum, 1-float64(persons)/area/movement.JamDensity)
+}
+
+// ClosedLink nodeからnidに向かう通行止めのリンク
+func (node *NodeEntity) ClosedLink(nid int) (NeighborEntity, bool) {
+	for _, neighbor := range node.ClosedNeighbors {
+		if neighbor.Node.NID == nid {
+			return neighbor, true
+		}
+	}
+	return NeighborEntity{}, false
+}
@@ -7,21 +7,45 @@ import (
 
 // SettingEntity 設定ファイルのエンティティ
 type SettingEntity struct {
-	UniverseID       string                   `json:"UniverseID"`
-	BrokerAddress    string                   `json:"BrokerAddress"`
-	MinimumStepTime  int                      `json:"MinimumStepTime"`
-	MapWidth         float64                  `json:"MapWidth"`
-	MapHeight        float64                  `json:"MapHeight"`
-	UseGPU           bool                     `json:"UseGPU"`
-	FloodMeshSize    float64                  `json:"FloodMeshSize"`
-	RootPath         string                   `json:"RootPath"`
-	UniverseFilePath string                   `json:"UniverseFilePath"`
-	FloodFilePath    string                   `json:"FloodFilePath"`
-	Nodes            []SettingNodeEntity      `json:"Nodes"`
-	Potentials       []SettingPotentialEntity `json:"Potential"`
+	UniverseID         string                   `json:"UniverseID"`
+	LegacyTopics       bool                     `json:"LegacyTopics"` // 可視化ツール向けの旧トピック名（UniverseIDを含まない）を使う
+	BrokerAddress      string                   `json:"BrokerAddress"`
+	Transport          string                   `json:"Transport"`          // 通信方式（mqtt：ブローカー経由、memory：プロセス内）
+	EmbeddedBrokerPort int                      `json:"EmbeddedBrokerPort"` // 組み込みMQTTブローカーのポート（0：起動しない）
+	MaxPacketSize      int                      `json:"MaxPacketSize"`      // 組み込みMQTTブローカーが受け付けるパケットの最大サイズ（バイト、0：64MB）
+	Encoding           string                   `json:"Encoding"`           // モジュール間のペイロードの形式（json：既定、binary：対応しているモジュールのみ）
+	ControlAddress     string                   `json:"ControlAddress"`     // Universeの遠隔操作のHTTP APIのアドレス（例 ":8080"、空：起動しない）
+	MinimumStepTime    int                      `json:"MinimumStepTime"`    // ステップの最小時間（ミリ秒、負：ステップ毎に入力を待つ）
+	HeartbeatInterval  int                      `json:"HeartbeatInterval"`  // 生存通知の間隔（ミリ秒、0：通知しない）
+	HeartbeatTimeout   int                      `json:"HeartbeatTimeout"`   // 生存通知が途絶えたモジュールを離脱扱いにするまでの時間（ミリ秒、0：監視しない）
+	StepTimeout        int                      `json:"StepTimeout"`        // ステップ（各フェーズ）の制限時間（ミリ秒、0：無制限）
+	TimeoutPolicy      string                   `json:"TimeoutPolicy"`      // 制限時間を超えた場合の動作（abort：中止、skip：モジュールを外す、retry：再実行）
+	StepRetryCount     int                      `json:"StepRetryCount"`     // retryの最大回数（超えた場合は中止）
+	RouteTimeout       int                      `json:"RouteTimeout"`       // Personモジュールが経路要求の応答を待つ時間（ミリ秒、0：1000、過ぎた場合は要求を捨てる）
+	Seed               int64                    `json:"Seed"`               // 乱数のシード（0：実行毎に変える）
+	StopCriteria       SettingStopEntity        `json:"StopCriteria"`       // サイクルをStepCountより前に終了する条件（全て0：StepCountまで実行）
+	Routing            SettingRoutingEntity     `json:"Routing"`            // 経路計算のコスト（全て0：リンクの長さのみ）
+	Movement           SettingMovementEntity    `json:"Movement"`           // リンクの混雑による歩く速さの低下と入口での待ち（JamDensityが0：混雑を考えない）
+	MapWidth           float64                  `json:"MapWidth"`
+	MapHeight          float64                  `json:"MapHeight"`
+	UseGPU             bool                     `json:"UseGPU"`
+	FloodMeshSize      float64                  `json:"FloodMeshSize"`
+	RootPath           string                   `json:"RootPath"`
+	UniverseFilePath   string                   `json:"UniverseFilePath"`
+	ScenarioFilePath   string                   `json:"ScenarioFilePath"` // サイクル毎の設定を書いたシナリオファイル（JSON、空：UniverseFilePathを使う）
+	FloodFilePath      string                   `json:"FloodFilePath"`
+	RecordFilePath     string                   `json:"RecordFilePath"`     // 全てのメッセージを記録するファイル（空：記録しない）
+	ReplayFilePath     string                   `json:"ReplayFilePath"`     // 記録したファイルから外部入力（カメラ、メッセージ）を再生する（空：再生しない）
+	CheckpointInterval int                      `json:"CheckpointInterval"` // チェックポイントを保存するステップの間隔（0：保存しない）
+	CheckpointPath     string                   `json:"CheckpointPath"`     // チェックポイントを保存するディレクトリ（ステップ毎にサブディレクトリを作る）
+	RestorePath        string                   `json:"RestorePath"`        // 再開するチェックポイントのディレクトリ（空：最初から実行）
+	Nodes              []SettingNodeEntity      `json:"Nodes"`
+	Potentials         []SettingPotentialEntity `json:"Potential"`
+	Sweep              SettingSweepEntity       `json:"Sweep"` // パラメータスイープ（aria_batch -sweepで使う）
 }
 
 type SettingNodeEntity struct {
+	ModuleName             string `json:"ModuleName"` // モジュール名（再接続や再起動で同じIDの範囲を使う、空の場合はランダム）
 	MaximumInfluenceLength int    `json:"MaximumInfluenceLength"`
 	PersonFilePath         string `json:"PersonFilePath"`
 	NodeFilePath           string `json:"NodeFilePath"`
@@ -30,6 +54,7 @@ type SettingNodeEntity struct {
 }
 
 type SettingPotentialEntity struct {
+	ModuleName     string                           `json:"ModuleName"` // モジュール名（再接続や再起動で同じIDの範囲を使う、空の場合はランダム）
 	MeshSize       float64                          `json:"MeshSize"`
 	PersonFilePath string                           `json:"PersonFilePath"`
 	InternalMaps   string                           `json:"InternalMaps"`
@@ -43,6 +68,7 @@ type SettingPotentialExternalEntity struct {
 	IsJSON    bool   `json:"IsJSON"`
 	IsWall    bool   `json:"IsWall"`
 	IsShelter bool   `json:"IsShelter"`
+	Capacity  int    `json:"Capacity"` // 避難場所の収容人数（IsShelterの場合、マップ全体で1つの避難場所、0：無制限）
 }
 
 type SettingPotentialDisasterEntity struct {
@@ -64,6 +90,52 @@ type SettingPositionEntity struct {
 	Y float64 `json:"Y"`
 }
 
+// SettingStopEntity サイクルの終了条件（いずれかを満たせば終了する）
+type SettingStopEntity struct {
+	AllSettled     bool    `json:"AllSettled"`     // 全てのパーソンが被災（6）か避難完了（7）になった
+	SteadySteps    int     `json:"SteadySteps"`    // 全てのパーソンの状態がこのステップ数の間変化しなかった（0：判定しない）
+	EvacuatedRatio float64 `json:"EvacuatedRatio"` // 避難完了の割合がこの値に達した（0：判定しない）
+	TimeBudget     int     `json:"TimeBudget"`     // サイクルの開始からの経過時間（ミリ秒、0：判定しない）
+}
+
+// SettingRoutingEntity 経路計算のコスト（リンクの長さに加える項）
+type SettingRoutingEntity struct {
+	FloodLimit        float64 `json:"FloodLimit"`        // この水深（m）を超えたノードから先には進まない（0：0.5）
+	FloodWeight       float64 `json:"FloodWeight"`       // 進む先のノードの水深1mあたりにリンクの長さに掛ける割合
+	SlopeWeight       float64 `json:"SlopeWeight"`       // 上り1mあたりに加えるコスト（リンクの長さと同じ単位）
+	CongestionWeight  float64 `json:"CongestionWeight"`  // 進む先のノードにいる1人あたりにリンクの長さに掛ける割合（前ステップの交換フェーズの位置）
+	ForecastSteps     int     `json:"ForecastSteps"`     // 到着時の予測水深を見るステップ数（FloodFilePathの先のステップ、0：現在の水深のみ）
+	ForecastSpeed     float64 `json:"ForecastSpeed"`     // 要求に歩く速さがない場合の1ステップの移動距離（0：現在の水深のみ）
+	SafestFloodWeight float64 `json:"SafestFloodWeight"` // safestのプロファイルのFloodWeight（0：10）
+	MainRoadWidth     float64 `json:"MainRoadWidth"`     // main_roadsのプロファイルで主要道路とするリンクの幅（LinkFilePathの5列目、0：6）
+	MinorRoadWeight   float64 `json:"MinorRoadWeight"`   // main_roadsのプロファイルで主要道路以外のリンクの長さに加える割合（0：1）
+}
+
+// SettingMovementEntity リンクの混雑による移動（密度から歩く速さを求め、満員のリンクの入口で待つ）
+type SettingMovementEntity struct {
+	JamDensity        float64 `json:"JamDensity"`        // 歩けなくなる密度（人/m²、0：混雑を考えない）
+	MinimumSpeedRatio float64 `json:"MinimumSpeedRatio"` // 混雑したリンクの歩く速さの下限（Speedに対する割合、0：0.1）
+	DefaultWidth      float64 `json:"DefaultWidth"`      // 幅がないリンクの幅（m、0：幅がないリンクは混雑を考えない）
+}
+
+// SettingSweepEntity パラメータスイープの定義
+type SettingSweepEntity struct {
+	Method     string                        `json:"Method"`     // grid：全ての組み合わせ（既定）、lhs：ラテン超方格法
+	Samples    int                           `json:"Samples"`    // lhsのサンプル数
+	Runs       int                           `json:"Runs"`       // サンプル毎の実行回数（0：aria_batchの-runs）
+	Seed       int64                         `json:"Seed"`       // lhsのサンプリングに使う乱数のシード
+	Parameters []SettingSweepParameterEntity `json:"Parameters"` // 変化させるパラメータ（空：スイープしない）
+}
+
+// SettingSweepParameterEntity スイープするパラメータ
+type SettingSweepParameterEntity struct {
+	Name   string    `json:"Name"`   // パラメータ名（SweepAnnounceStepなど）
+	Values []float64 `json:"Values"` // 値の一覧（gridでは全ての値、lhsでは一覧から選ぶ）
+	From   float64   `json:"From"`   // 値の範囲（Valuesが空の場合）
+	To     float64   `json:"To"`
+	Count  int       `json:"Count"` // gridで範囲を分割する点の数
+}
+
 // LoadSettings 設定ファイルを読み込む
 func LoadSettings(fileName string) SettingEntity {
 
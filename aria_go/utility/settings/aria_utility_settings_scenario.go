@@ -0,0 +1,124 @@
+package aria_utility_settings
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// ScenarioEntity シナリオファイルのエンティティ（サイクルを順に実行し、最後まで行ったら最初に戻る）
+type ScenarioEntity struct {
+	Cycles []ScenarioCycleEntity `json:"Cycles"`
+}
+
+// ScenarioCycleEntity サイクル毎の設定（空の項目は設定ファイルの値を使う）
+type ScenarioCycleEntity struct {
+	Name            string                        `json:"Name"`            // 表示用の名前
+	AnnounceStep    int                           `json:"AnnounceStep"`    // アナウンスのステップ
+	StepCount       int                           `json:"StepCount"`       // サイクルのステップ数
+	FloodFilePath   string                        `json:"FloodFilePath"`   // 洪水のファイル（%dにステップ数が入る）
+	PersonFiles     map[string]string             `json:"PersonFiles"`     // パーソンファイルの置き換え（設定ファイルのPersonFilePath：このサイクルのファイル、人数は同じ）
+	ShelterFilePath string                        `json:"ShelterFilePath"` // 避難場所のファイル
+	OpenShelters    []int                         `json:"OpenShelters"`    // 避難場所として開設するノード
+	ClosedShelters  []int                         `json:"ClosedShelters"`  // 閉鎖する避難場所のノード
+	ClosedLinks     []int                         `json:"ClosedLinks"`     // 通行止めのリンクのID（LinkFilePathの1列目）
+	Media           []SettingPotentialMediaEntity `json:"Media"`           // メディア（nil：設定ファイルの値、空の配列：メディアなし）
+	Events          []ScenarioEventEntity         `json:"Events"`          // ステップ毎の地図の変更（aria/event/+でPublishする）
+}
+
+// ScenarioEventEntity 指定したステップの開始時の地図の変更
+type ScenarioEventEntity struct {
+	Step   int    `json:"Step"`
+	Type   string `json:"Type"`   // shelter_open、shelter_close、link_close、link_open
+	Target int    `json:"Target"` // 避難場所はノードのID、リンクはリンクのID
+}
+
+// LoadScenario シナリオを読み込む（ScenarioFilePathが空の場合はUniverseFilePathのサイクルのみ）
+func LoadScenario(settings SettingEntity) (ScenarioEntity, error) {
+	var scenario ScenarioEntity
+	if settings.ScenarioFilePath == "" {
+		file, err := os.Open(settings.UniverseFilePath)
+		if err != nil {
+			return scenario, err
+		}
+		defer file.Close()
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		reader.Read()
+		for {
+			line, e := reader.Read()
+			if e == io.EOF || len(line) < 2 {
+				break
+			}
+
+			announceStep, _ := strconv.Atoi(line[0])
+			stepCount, _ := strconv.Atoi(line[1])
+			scenario.Cycles = append(scenario.Cycles, ScenarioCycleEntity{
+				AnnounceStep: announceStep,
+				StepCount:    stepCount,
+			})
+		}
+	} else {
+		buffer, err := ioutil.ReadFile(settings.ScenarioFilePath)
+		if err != nil {
+			return scenario, err
+		}
+
+		// 項目名の間違いに気付けるように、知らない項目はエラーにする
+		decoder := json.NewDecoder(bytes.NewReader(buffer))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&scenario); err != nil {
+			return scenario, fmt.Errorf("%s: %v", settings.ScenarioFilePath, err)
+		}
+	}
+
+	if len(scenario.Cycles) == 0 {
+		return scenario, fmt.Errorf("no cycles in the scenario")
+	}
+	for no, cycle := range scenario.Cycles {
+		if cycle.StepCount < 1 {
+			return scenario, fmt.Errorf("Cycles[%d]: StepCount %d is less than 1", no, cycle.StepCount)
+		}
+	}
+	return scenario, nil
+}
+
+// Cycle サイクル数に対応するサイクルの設定
+func (scenario ScenarioEntity) Cycle(cycleCount int) ScenarioCycleEntity {
+	return scenario.Cycles[cycleCount%len(scenario.Cycles)]
+}
+
+// Apply サイクルの設定を反映した設定（共通の項目のみ）
+func (cycle ScenarioCycleEntity) Apply(settings SettingEntity) SettingEntity {
+	if cycle.FloodFilePath != "" {
+		settings.FloodFilePath = cycle.FloodFilePath
+	}
+	return settings
+}
+
+// ApplyNode サイクルの設定を反映したNodesの設定
+func (cycle ScenarioCycleEntity) ApplyNode(nodeEntity SettingNodeEntity) SettingNodeEntity {
+	if fileName, exists := cycle.PersonFiles[nodeEntity.PersonFilePath]; exists {
+		nodeEntity.PersonFilePath = fileName
+	}
+	if cycle.ShelterFilePath != "" {
+		nodeEntity.ShelterFilePath = cycle.ShelterFilePath
+	}
+	return nodeEntity
+}
+
+// ApplyPotential サイクルの設定を反映したPotentialの設定
+func (cycle ScenarioCycleEntity) ApplyPotential(potentialEntity SettingPotentialEntity) SettingPotentialEntity {
+	if fileName, exists := cycle.PersonFiles[potentialEntity.PersonFilePath]; exists {
+		potentialEntity.PersonFilePath = fileName
+	}
+	if cycle.Media != nil {
+		potentialEntity.Media = cycle.Media
+	}
+	return potentialEntity
+}
@@ -0,0 +1,144 @@
+package aria_utility_settings
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// スイープの方法
+const (
+	SweepGrid = "grid" // 全ての値の組み合わせ
+	SweepLHS  = "lhs"  // ラテン超方格法（範囲をSamples個の区間に分けて、パラメータ毎に各区間から1回ずつ選ぶ）
+)
+
+// スイープできるパラメータ
+const (
+	SweepAnnounceStep           = "AnnounceStep"           // 全てのサイクルのアナウンスのステップ（UniverseFilePathの1列目、またはシナリオファイル）
+	SweepMaximumInfluenceLength = "MaximumInfluenceLength" // 全てのNodesのMaximumInfluenceLength
+	SweepPrepareTimeoutScale    = "PrepareTimeoutScale"    // 全てのパーソンの準備時間の倍率（PersonFilePathの4列目、分布の形は保つ）
+	SweepMediaAcquisition       = "MediaAcquisition"       // 全てのメディアの取得率
+)
+
+// SweepParameters スイープできるパラメータの一覧
+var SweepParameters = []string{SweepAnnounceStep, SweepMaximumInfluenceLength, SweepPrepareTimeoutScale, SweepMediaAcquisition}
+
+// SweepSample スイープの1つのサンプル（Parametersと同じ順の値）
+type SweepSample []float64
+
+// Names パラメータ名の一覧
+func (sweep SettingSweepEntity) Names() []string {
+	names := []string{}
+	for _, parameter := range sweep.Parameters {
+		names = append(names, parameter.Name)
+	}
+	return names
+}
+
+// Expand スイープの定義をサンプルの一覧に展開する
+func (sweep SettingSweepEntity) Expand() ([]SweepSample, error) {
+	if len(sweep.Parameters) == 0 {
+		return nil, fmt.Errorf("no sweep parameters")
+	}
+	for _, parameter := range sweep.Parameters {
+		if err := parameter.validate(sweep.Method); err != nil {
+			return nil, err
+		}
+	}
+
+	var samples []SweepSample
+	switch sweep.Method {
+	case "", SweepGrid:
+		samples = sweep.expandGrid()
+	case SweepLHS:
+		if sweep.Samples < 1 {
+			return nil, fmt.Errorf("Samples: %d is less than 1", sweep.Samples)
+		}
+		samples = sweep.expandLHS()
+	default:
+		return nil, fmt.Errorf("Method: unknown method %q", sweep.Method)
+	}
+
+	// 整数のパラメータは丸めておく（結果の表に実際に使った値を出す）
+	for _, sample := range samples {
+		for no, parameter := range sweep.Parameters {
+			if parameter.Name == SweepAnnounceStep || parameter.Name == SweepMaximumInfluenceLength {
+				sample[no] = math.Round(sample[no])
+			}
+		}
+	}
+	return samples, nil
+}
+
+// 全ての値の組み合わせ（最初のパラメータが最も遅く変わる）
+func (sweep SettingSweepEntity) expandGrid() []SweepSample {
+	samples := []SweepSample{{}}
+	for _, parameter := range sweep.Parameters {
+		next := []SweepSample{}
+		for _, sample := range samples {
+			for _, value := range parameter.gridValues() {
+				next = append(next, append(append(SweepSample{}, sample...), value))
+			}
+		}
+		samples = next
+	}
+	return samples
+}
+
+// ラテン超方格法（シードが同じなら同じサンプル）
+func (sweep SettingSweepEntity) expandLHS() []SweepSample {
+	random := rand.New(rand.NewSource(sweep.Seed))
+	samples := make([]SweepSample, sweep.Samples)
+	for index := range samples {
+		samples[index] = make(SweepSample, len(sweep.Parameters))
+	}
+	for no, parameter := range sweep.Parameters {
+		for index, stratum := range random.Perm(sweep.Samples) {
+			position := (float64(stratum) + random.Float64()) / float64(sweep.Samples)
+			if len(parameter.Values) > 0 {
+				samples[index][no] = parameter.Values[int(position*float64(len(parameter.Values)))]
+			} else {
+				samples[index][no] = parameter.From + position*(parameter.To-parameter.From)
+			}
+		}
+	}
+	return samples
+}
+
+// gridで使う値
+func (parameter SettingSweepParameterEntity) gridValues() []float64 {
+	if len(parameter.Values) > 0 {
+		return parameter.Values
+	}
+	if parameter.Count == 1 {
+		return []float64{parameter.From}
+	}
+	values := []float64{}
+	for i := 0; i < parameter.Count; i++ {
+		values = append(values, parameter.From+(parameter.To-parameter.From)*float64(i)/float64(parameter.Count-1))
+	}
+	return values
+}
+
+// パラメータ名と値の範囲の検証
+func (parameter SettingSweepParameterEntity) validate(method string) error {
+	isKnown := false
+	for _, name := range SweepParameters {
+		if parameter.Name == name {
+			isKnown = true
+		}
+	}
+	if !isKnown {
+		return fmt.Errorf("%s: unknown sweep parameter (one of %v)", parameter.Name, SweepParameters)
+	}
+	if len(parameter.Values) > 0 {
+		return nil
+	}
+	if parameter.To < parameter.From {
+		return fmt.Errorf("%s: To %v is less than From %v", parameter.Name, parameter.To, parameter.From)
+	}
+	if method != SweepLHS && parameter.Count < 1 {
+		return fmt.Errorf("%s: Values or Count is required for grid", parameter.Name)
+	}
+	return nil
+}